@@ -0,0 +1,194 @@
+package potoo
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+)
+
+const defaultSignatureMaxAge = 30 * time.Second
+
+// Caller is the identity of the client which performs a call
+type Caller struct {
+	ID       string   // empty for anonymous callers
+	Verified bool     // the identity is signed with CallerSecret
+	Roles    []string // the roles of the caller, obtained via ConnectionOptions.Roles
+}
+
+// HasRole tells if the caller has any of the given roles
+func (c Caller) HasRole(roles ...string) bool {
+	for _, want := range roles {
+		for _, have := range c.Roles {
+			if want == have {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// callHeader holds the parts of a call message, which is
+// "<reply topic> <token> [@<identity>[:<timestamp>:<signature>]] <argument>"
+type callHeader struct {
+	replyTopic []byte
+	token      []byte
+	identity   []byte
+	timestamp  []byte // in milliseconds since the Unix epoch
+	signature  []byte
+	argument   []byte
+	version    int
+}
+
+func parseCallMessage(payload []byte) (h callHeader) {
+	if isObjectMessage(payload) {
+		return parseCallObject(payload)
+	}
+
+	h.version = ProtocolV1
+	limitedSplit(payload, ' ', &h.replyTopic, &h.token, &h.argument)
+
+	// JSON values never start with "@", and binary values which do are
+	// a single byte
+	if bytes.HasPrefix(h.argument, []byte("@")) && bytes.IndexByte(h.argument, ' ') >= 0 {
+		var identity []byte
+		limitedSplit(h.argument, ' ', &identity, &h.argument)
+		identity = identity[1:]
+		if idx := bytes.IndexByte(identity, ':'); idx >= 0 {
+			limitedSplit(identity[idx+1:], ':', &h.timestamp, &h.signature)
+			identity = identity[:idx]
+		}
+		h.identity = identity
+	}
+	return
+}
+
+// signCall returns the signature of a call, which is the hex-encoded
+// HMAC-SHA256 of
+// "<call topic> <reply topic> <token> <timestamp> <identity> <argument>"
+func signCall(secret []byte, topic mqtt.Topic, h callHeader) []byte {
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range [][]byte{topic, h.replyTopic, h.token, h.timestamp, h.identity} {
+		mac.Write(part)
+		mac.Write([]byte{' '})
+	}
+	mac.Write(h.argument)
+
+	sum := mac.Sum(nil)
+	sig := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(sig, sum)
+	return sig
+}
+
+// identifyCaller checks the identity of the caller of a call message
+func (c *Connection) identifyCaller(topic mqtt.Topic, h callHeader) (Caller, error) {
+	caller := Caller{ID: string(h.identity)}
+
+	if len(h.signature) > 0 && c.opts.CallerSecret != nil {
+		expected := signCall(c.opts.CallerSecret, topic, h)
+		if !hmac.Equal(expected, h.signature) {
+			return caller, fmt.Errorf("invalid signature for caller '%s'", caller.ID)
+		}
+		err := c.checkFreshness(h)
+		if err != nil {
+			return caller, fmt.Errorf("rejected call from '%s': %s", caller.ID, err)
+		}
+		caller.Verified = true
+	}
+
+	if caller.ID != "" && c.opts.Roles != nil && (caller.Verified || c.opts.TrustUnverifiedCallers) {
+		caller.Roles = c.opts.Roles(caller.ID)
+	}
+	return caller, nil
+}
+
+// checkFreshness rejects signed calls which are too old (or too far in
+// the future), and ones whose signature has been seen before
+func (c *Connection) checkFreshness(h callHeader) error {
+	maxAge := c.opts.SignatureMaxAge
+	if maxAge == 0 {
+		maxAge = defaultSignatureMaxAge
+	}
+
+	ms, err := strconv.ParseInt(string(h.timestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp '%s'", h.timestamp)
+	}
+	now := time.Now()
+	age := now.Sub(time.Unix(0, ms*int64(time.Millisecond)))
+	if age > maxAge || age < -maxAge {
+		return fmt.Errorf("timestamp is off by %s", age)
+	}
+
+	// a signature is accepted until its timestamp is maxAge in the past,
+	// which is at most 2*maxAge after it first arrives
+	for len(c.seenSignatureQueue) > 0 && now.Sub(c.seenSignatureQueue[0].seen) > 2*maxAge {
+		delete(c.seenSignatures, c.seenSignatureQueue[0].key)
+		c.seenSignatureQueue[0] = seenToken{}
+		c.seenSignatureQueue = c.seenSignatureQueue[1:]
+	}
+
+	key := string(h.signature)
+	if _, ok := c.seenSignatures[key]; ok {
+		return fmt.Errorf("the call is a replay")
+	}
+	c.seenSignatures[key] = struct{}{}
+	c.seenSignatureQueue = append(c.seenSignatureQueue, seenToken{key: key, seen: now})
+	return nil
+}
+
+// authorizeCall identifies the caller and checks if it may call the
+// callable. The returned error is ready to be sent as a reply.
+func (c *Connection) authorizeCall(msg mqtt.Message, callable *contracts.Callable) (Caller, *Error) {
+	caller, err := c.identifyCaller(msg.Topic, parseCallMessage(msg.Payload))
+	if err != nil {
+		return caller, newError(PermissionDenied, msg.Topic, "%s", err)
+	}
+	return caller, c.permitCall(caller, msg.Topic, callable)
+}
+
+// permitCall checks if an identified caller may call the callable on topic
+func (c *Connection) permitCall(caller Caller, topic mqtt.Topic, callable *contracts.Callable) *Error {
+	if len(callable.Roles) > 0 && !caller.HasRole(callable.Roles...) {
+		return newError(PermissionDenied, topic, "caller '%s' doesn't have any of the roles %v", caller.ID, callable.Roles)
+	}
+
+	if c.opts.Authorize != nil {
+		err := c.opts.Authorize(caller, topic, callable)
+		if err != nil {
+			return newError(PermissionDenied, topic, "%w", err)
+		}
+	}
+	return nil
+}
+
+// identifyCall fills in our identity, and signs the call if we have a
+// secret. The argument must be exactly as it's going to be sent.
+func (c *Connection) identifyCall(topic mqtt.Topic, h *callHeader) {
+	if c.opts.Identity == "" {
+		return
+	}
+	h.identity = []byte(c.opts.Identity)
+	if c.opts.CallerSecret != nil {
+		h.timestamp = strconv.AppendInt(nil, time.Now().UnixNano()/int64(time.Millisecond), 10)
+		h.signature = signCall(c.opts.CallerSecret, topic, *h)
+	}
+}
+
+// callerField returns the identity field of version 1 call messages
+func callerField(h callHeader) []byte {
+	field := append([]byte("@"), h.identity...)
+	if h.signature != nil {
+		field = append(field, ':')
+		field = append(field, h.timestamp...)
+		field = append(field, ':')
+		field = append(field, h.signature...)
+	}
+	return field
+}
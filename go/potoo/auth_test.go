@@ -0,0 +1,220 @@
+package potoo
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+var secret = []byte("hunter2")
+
+func adminContract() contracts.Map {
+	return contracts.Map{
+		"reboot": contracts.Callable{
+			Argument: types.Struct(map[string]types.Type{"reason": types.String()}),
+			Retval:   types.String(),
+			Roles:    []string{"admin"},
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				return arg.Get("reason")
+			},
+		},
+	}
+}
+
+func admins(identity string) []string {
+	if identity == "alice" {
+		return []string{"admin"}
+	}
+	return nil
+}
+
+// signedCall returns a version 1 call to things/svc/reboot signed at the
+// given time
+func signedCall(token string, at time.Time, argument string) []byte {
+	h := callHeader{
+		replyTopic: []byte("r"),
+		token:      []byte(token),
+		identity:   []byte("alice"),
+		timestamp:  strconv.AppendInt(nil, at.UnixNano()/int64(time.Millisecond), 10),
+		argument:   []byte(argument),
+	}
+	h.signature = signCall(secret, mqtt.Topic("_call/things/svc/reboot"), h)
+	return []byte("r " + token + " " + string(callerField(h)) + " " + argument)
+}
+
+// expectReplyCode waits for a reply on _reply/r and checks its error code
+// ("" for a successful reply)
+func expectReplyCode(t *testing.T, replies <-chan mqtt.Message, code string) {
+	t.Helper()
+
+	reply := receive(t, replies, "_reply/r")
+	_, data := parseReplyMessage(reply.Payload)
+	_, err := parseReply(data, nil)
+	var rerr *RemoteError
+	switch {
+	case code == "" && err != nil:
+		t.Errorf("call failed with %s", err)
+	case code != "" && (!errors.As(err, &rerr) || rerr.Code != code):
+		t.Errorf("reply '%s' isn't a %s error", reply.Payload, code)
+	}
+}
+
+func TestSignedCalls(t *testing.T) {
+	for _, version := range []int{ProtocolV1, ProtocolV2} {
+		b := newFakeBroker()
+		startService(t, b, ConnectionOptions{CallerSecret: secret, Roles: admins}, adminContract())
+		cl := startClient(t, b, ConnectionOptions{Identity: "alice", CallerSecret: secret, ProtocolVersion: version})
+
+		// the argument contains characters which are escaped differently
+		// by different JSON encoders
+		arg := q.Json(map[string]interface{}{"reason": "naïve \"update\""})
+		r, err := cl.Call(context.Background(), mqtt.Topic("svc/reboot"), arg)
+		if err != nil || string(r.GetStringBytes()) != "naïve \"update\"" {
+			t.Errorf("signed version %d call returned (%v, %v)", version, r, err)
+		}
+	}
+}
+
+func TestSignedCallExactArgument(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{CallerSecret: secret, Roles: admins}, adminContract())
+	peer, replies := b.peer("_reply/#")
+
+	argument := `{ "reason" : "naïve" }`
+	h := callHeader{
+		replyTopic: []byte("r"),
+		token:      []byte("t1"),
+		identity:   []byte("alice"),
+		timestamp:  strconv.AppendInt(nil, time.Now().UnixNano()/int64(time.Millisecond), 10),
+		argument:   []byte(argument),
+	}
+	h.signature = signCall(secret, mqtt.Topic("_call/things/svc/reboot"), h)
+	peer.Publish(mqtt.Message{Topic: mqtt.Topic("_call/things/svc/reboot"), Payload: appendCallObject(nil, h)})
+	expectReplyCode(t, replies, "")
+}
+
+func TestCallFreshness(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{CallerSecret: secret, Roles: admins, SignatureMaxAge: time.Second}, adminContract())
+	peer, replies := b.peer("_reply/#")
+	call := func(payload []byte) {
+		peer.Publish(mqtt.Message{Topic: mqtt.Topic("_call/things/svc/reboot"), Payload: payload})
+	}
+
+	fresh := signedCall("t1", time.Now(), `{"reason":"update"}`)
+	call(fresh)
+	expectReplyCode(t, replies, "")
+	call(fresh)
+	expectReplyCode(t, replies, "permission_denied")
+
+	call(signedCall("t2", time.Now().Add(-time.Minute), `{"reason":"update"}`))
+	expectReplyCode(t, replies, "permission_denied")
+	call(signedCall("t3", time.Now().Add(time.Minute), `{"reason":"update"}`))
+	expectReplyCode(t, replies, "permission_denied")
+
+	tampered := signedCall("t4", time.Now(), `{"reason":"update"}`)
+	call(append(tampered[:len(tampered)-len(`"update"}`)], `"attack"}`...))
+	expectReplyCode(t, replies, "permission_denied")
+}
+
+func TestUnverifiedRoles(t *testing.T) {
+	for _, trust := range []bool{false, true} {
+		b := newFakeBroker()
+		startService(t, b, ConnectionOptions{Roles: admins, TrustUnverifiedCallers: trust}, adminContract())
+		cl := startClient(t, b, ConnectionOptions{Identity: "alice"})
+
+		_, err := cl.Call(context.Background(), mqtt.Topic("svc/reboot"), q.Json(map[string]interface{}{"reason": "update"}))
+		var rerr *RemoteError
+		denied := errors.As(err, &rerr) && rerr.Code == "permission_denied"
+		if denied == trust {
+			t.Errorf("unsigned call with TrustUnverifiedCallers=%v returned %v", trust, err)
+		}
+	}
+}
+
+type authorization struct {
+	caller Caller
+	topic  string
+}
+
+func TestAuthorize(t *testing.T) {
+	b := newFakeBroker()
+	authorized := make(chan authorization, 16)
+	contract := adminContract()
+	contract["ping"] = fast
+	startService(t, b, ConnectionOptions{
+		Roles:                  admins,
+		TrustUnverifiedCallers: true,
+		Authorize: func(caller Caller, topic mqtt.Topic, callable *contracts.Callable) error {
+			authorized <- authorization{caller: caller, topic: string(topic)}
+			if caller.ID == "bob" {
+				return errors.New("not today")
+			}
+			return nil
+		},
+	}, contract)
+	expectAuthorization := func(id string, admin bool, topic string) {
+		t.Helper()
+		select {
+		case a := <-authorized:
+			if a.caller.ID != id || a.caller.HasRole("admin") != admin || a.topic != topic {
+				t.Errorf("%+v was authorized instead of %s on %s", a, id, topic)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s wasn't authorized on %s", id, topic)
+		}
+	}
+
+	alice := startClient(t, b, ConnectionOptions{Identity: "alice", InstanceID: "alice"})
+	_, err := alice.Call(context.Background(), mqtt.Topic("svc/reboot"), q.Json(map[string]interface{}{"reason": "update"}))
+	if err != nil {
+		t.Errorf("authorized call failed: %s", err)
+	}
+	expectAuthorization("alice", true, "_call/things/svc/reboot")
+
+	bob := startClient(t, b, ConnectionOptions{Identity: "bob", InstanceID: "bob"})
+	_, err = bob.Call(context.Background(), mqtt.Topic("svc/ping"), q.Json(nil))
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != "permission_denied" {
+		t.Errorf("denied call returned %v", err)
+	}
+	expectAuthorization("bob", false, "_call/things/svc/ping")
+
+	items := sendBatchAs(t, b, "bob", `{"calls": [{"path": "ping"}]}`)
+	expectItems(t, items, "permission_denied")
+	expectAuthorization("bob", false, "_call/things/svc/ping")
+
+	items = sendBatchAs(t, b, "alice", `{"calls": [{"path": "ping"}, {"path": "reboot", "argument": {"reason": "update"}}]}`)
+	expectItems(t, items, "null", `"update"`)
+	expectAuthorization("alice", true, "_call/things/svc/ping")
+	expectAuthorization("alice", true, "_call/things/svc/reboot")
+}
+
+func TestRawObjectField(t *testing.T) {
+	tests := []struct {
+		data string
+		key  string
+		want string
+	}{
+		{`{"a":1,"b":2}`, "b", "2"},
+		{` { "a" : [1, {"b": "}"}] , "b" : "x\"y" } `, "b", `"x\"y"`},
+		{`{"a":{"b":1},"b":{"c":[true, null]}}`, "b", `{"c":[true, null]}`},
+		{`{"a":"\\","b":-1.5e3}`, "b", "-1.5e3"},
+		{`{"a":1}`, "b", ""},
+		{`[1]`, "b", ""},
+	}
+	for _, test := range tests {
+		got := rawObjectField([]byte(test.data), test.key)
+		if string(got) != test.want {
+			t.Errorf("rawObjectField(%s, %s) = '%s', want '%s'", test.data, test.key, got, test.want)
+		}
+	}
+}
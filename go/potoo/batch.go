@@ -0,0 +1,227 @@
+package potoo
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/logging"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/valyala/fastjson"
+)
+
+type pendingBatch struct {
+	topic     mqtt.Topic
+	token     []byte
+	version   int
+	tokens    []string // of the calls
+	items     [][]byte
+	remaining int
+}
+
+type batchEntry struct {
+	msg      mqtt.Message
+	callable *contracts.Callable
+	err      *Error
+}
+
+// callTopics lists the topics on which the service accepts calls
+func (c *Connection) callTopics() []mqtt.Topic {
+	if len(c.serviceCallableIndex) == 0 {
+		return nil
+	}
+
+	topics := make([]mqtt.Topic, 0, len(c.serviceCallableIndex)+1)
+	for topic := range c.serviceCallableIndex {
+		topics = append(topics, mqtt.Topic(topic))
+	}
+	return append(topics, c.batchTopic)
+}
+
+// handleBatch performs the calls of a batch message and sends a single
+// reply with the result (or the error) of each call. The calls of an
+// atomic batch must be synchronous: all of them are checked before any
+// is performed, and then they run one after another with nothing in
+// between. The first failure aborts the rest of an atomic batch, but the
+// calls which have already succeeded are not undone.
+func (c *Connection) handleBatch(msg mqtt.Message) {
+	if c.duplicateCall(msg) {
+		return
+	}
+
+	h := parseCallMessage(msg.Payload)
+	caller, err := c.identifyCaller(msg.Topic, h)
+	if err != nil {
+		c.rejectCall(msg, newError(PermissionDenied, msg.Topic, "%s", err))
+		return
+	}
+
+	parser := c.parserPool.Get()
+	defer c.parserPool.Put(parser)
+
+	batch, err := parser.ParseBytes(h.argument)
+	if err != nil {
+		c.rejectCall(msg, newError(BadArgument, msg.Topic, "unable to parse batch: %s", err))
+		return
+	}
+	if batch.Type() != fastjson.TypeObject || batch.Get("calls") == nil || batch.Get("calls").Type() != fastjson.TypeArray {
+		c.rejectCall(msg, newError(BadArgument, msg.Topic, "batch has no list of calls"))
+		return
+	}
+	calls := batch.GetArray("calls")
+	atomic := batch.GetBool("atomic")
+
+	b := &pendingBatch{
+		token:     append([]byte(nil), h.token...),
+		version:   h.version,
+		tokens:    make([]string, len(calls)),
+		items:     make([][]byte, len(calls)),
+		remaining: len(calls),
+	}
+	if len(h.replyTopic) != 0 {
+		b.topic = mqtt.JoinTopics(mqtt.Topic("_reply"), mqtt.Topic(h.replyTopic))
+	}
+
+	entries := make([]batchEntry, len(calls))
+	reserved := make(map[*tokenBucket]int)
+	failed := false
+	for i, call := range calls {
+		b.tokens[i] = string(call.GetStringBytes("token"))
+		if b.tokens[i] == "" {
+			b.tokens[i] = strconv.Itoa(i)
+		}
+		entries[i] = c.batchEntry(h.replyTopic, b.tokens[i], call, caller, atomic, reserved)
+		failed = failed || entries[i].err != nil
+	}
+	c.log.Debug("batch", logging.KeyTopic, string(msg.Topic), logging.KeyToken, string(h.token),
+		"calls", len(calls), "atomic", atomic)
+
+	if len(calls) == 0 {
+		c.publishBatch(b)
+		return
+	}
+
+	for i, e := range entries {
+		switch {
+		case e.err != nil:
+			c.rejectBatchItem(b, i, e.msg, e.err)
+		case atomic && failed:
+			c.rejectBatchItem(b, i, e.msg, newError(Aborted, e.msg.Topic, "another call in the batch failed"))
+		case c.rateLimited(e.msg, e.callable, caller):
+			// the tokens have been reserved, but other calls may have
+			// taken them while the async calls of the batch were queued
+			c.rejectBatchItem(b, i, e.msg, newError(RateLimited, e.msg.Topic, "too many calls"))
+			failed = true
+		case e.callable.Async:
+			c.handleAsyncCall(queuedCall{msg: e.msg, callable: e.callable, caller: caller, batch: b, index: i})
+		default:
+			started := time.Now()
+			result := c.handleCallHelper(c.arena, c.jsonparser, e.msg, e.callable, caller)
+			c.callDone(e.msg.Topic, started, result)
+			c.finaliseBatchItem(b, i, result)
+			if result.err != nil {
+				failed = true
+			}
+		}
+	}
+}
+
+// batchEntry turns a call of a batch into a call message and checks if
+// it may be performed. Rate limit tokens are only reserved here, and taken
+// when the call is performed.
+func (c *Connection) batchEntry(replyTopic []byte, token string, call *fastjson.Value, caller Caller, atomic bool, reserved map[*tokenBucket]int) (e batchEntry) {
+	path := call.GetStringBytes("path")
+	e.msg.Topic = c.serviceTopic(mqtt.Topic("_call"), mqtt.Topic(path))
+
+	argument := call.Get("argument")
+	if argument == nil {
+		argument = c.arena.NewNull()
+	}
+	// the argument is JSON whatever the encoding of the callable
+	e.msg.Payload = appendCallObject(nil, callHeader{
+		replyTopic: replyTopic,
+		token:      []byte(token),
+		argument:   argument.MarshalTo(nil),
+	})
+
+	var ok bool
+	e.callable, ok = c.serviceCallableIndex[string(e.msg.Topic)]
+	switch {
+	case path == nil:
+		e.err = newError(BadArgument, c.batchTopic, "batched call has no path")
+	case !ok:
+		e.err = newError(UnknownTopic, e.msg.Topic, "no such callable")
+	case e.callable.IsStream():
+		e.err = newError(BadArgument, e.msg.Topic, "streaming calls can't be batched")
+	case atomic && e.callable.Async:
+		e.err = newError(BadArgument, e.msg.Topic, "asynchronous calls can't be in an atomic batch")
+	}
+	if e.err != nil {
+		return
+	}
+
+	e.err = c.permitCall(caller, e.msg.Topic, e.callable)
+	if e.err != nil {
+		return
+	}
+
+	if atomic {
+		err := c.typeCheck(c.validation.Arguments, argument, e.callable.Argument, e.msg.Topic, "argument")
+		if err != nil {
+			e.err = newError(TypeMismatch, e.msg.Topic, "argument has wrong type: %w", err)
+			return
+		}
+	}
+
+	if !c.reserveTokens(e.msg, e.callable, caller, reserved) {
+		e.err = newError(RateLimited, e.msg.Topic, "too many calls")
+	}
+	return
+}
+
+func (c *Connection) rejectBatchItem(b *pendingBatch, i int, msg mqtt.Message, err *Error) {
+	if err.Category != Aborted {
+		c.log.Warn("call rejected", logging.KeyTopic, string(msg.Topic), logging.KeyToken, b.tokens[i],
+			logging.KeyError, err.Err)
+		c.recordRejectedCall(msg.Topic)
+	}
+	c.finaliseBatchItem(b, i, callResult{err: err})
+}
+
+// finaliseBatchItem stores the result of a batched call, and sends the
+// reply of the batch once all of its calls are done
+func (c *Connection) finaliseBatchItem(b *pendingBatch, i int, result callResult) {
+	item := c.arena.NewObject()
+	item.Set("token", c.arena.NewString(b.tokens[i]))
+	switch {
+	case result.err != nil:
+		if result.err.Category != Aborted {
+			c.err(result.err)
+		}
+		item.Set("error", encodeCallError(c.arena, result.err))
+	case result.payload != nil:
+		item.Set("result", result.payload)
+	default:
+		item.Set("result", c.arena.NewNull())
+	}
+	b.items[i] = item.MarshalTo(nil)
+
+	b.remaining--
+	if b.remaining == 0 {
+		c.publishBatch(b)
+	}
+}
+
+func (c *Connection) publishBatch(b *pendingBatch) {
+	if b.topic == nil {
+		return
+	}
+
+	payload := appendReplyHead(nil, b.version, b.token, "result", nil)
+	payload = append(payload, '[')
+	payload = append(payload, bytes.Join(b.items, []byte(","))...)
+	payload = append(payload, ']')
+	payload = appendReplyTail(payload, b.version)
+	c.publish(mqtt.Message{Topic: b.topic, Payload: payload})
+}
@@ -0,0 +1,214 @@
+package potoo
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+// batchContract returns a contract with synchronous, failing and async
+// callables, and counts the calls of svc/inc
+func batchContract(calls *int32) contracts.Map {
+	return contracts.Map{
+		"inc": contracts.Callable{
+			Argument: types.Int(),
+			Retval:   types.Int(),
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				atomic.AddInt32(calls, 1)
+				return a.NewNumberInt(arg.GetInt() + 1)
+			},
+		},
+		"fail": contracts.Callable{
+			Argument: types.Null(),
+			Retval:   types.Null(),
+			ErrHandler: func(a *fastjson.Arena, arg *fastjson.Value) (*fastjson.Value, error) {
+				return nil, errors.New("nope")
+			},
+		},
+		"double": contracts.Callable{
+			Argument: types.Int(),
+			Retval:   types.Int(),
+			Async:    true,
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				return a.NewNumberInt(arg.GetInt() * 2)
+			},
+		},
+		"ping": limited(&contracts.RateLimit{Rate: 0.001, Burst: 1}, nil),
+	}
+}
+
+// sendBatch publishes a batch with the given argument to things/svc and
+// returns the items of its reply
+func sendBatch(t *testing.T, b *fakeBroker, argument string) []*fastjson.Value {
+	t.Helper()
+	return sendBatchAs(t, b, "", argument)
+}
+
+// sendBatchAs is like sendBatch, but the batch claims to be sent by caller
+// (unless it's empty)
+func sendBatchAs(t *testing.T, b *fakeBroker, caller string, argument string) []*fastjson.Value {
+	t.Helper()
+
+	identity := ""
+	if caller != "" {
+		identity = `"caller": "` + caller + `", `
+	}
+
+	eventually(t, "the service subscribes to batches", func() bool {
+		return b.subscribed("_batch/things/svc")
+	})
+	peer, replies := b.peer("_reply/r")
+	peer.Publish(mqtt.Message{
+		Topic:   mqtt.Topic("_batch/things/svc"),
+		Payload: []byte(`{"version": 2, "topic": "r", "token": "b", ` + identity + `"argument": ` + argument + `}`),
+	})
+
+	reply := receive(t, replies, "_reply/r")
+	token, data := parseReplyMessage(reply.Payload)
+	if string(token) != "b" {
+		t.Fatalf("reply '%s' has the wrong token", reply.Payload)
+	}
+	result, err := parseReply(data, nil)
+	if err != nil {
+		t.Fatalf("batch failed: %s", err)
+	}
+	items, err := result.Array()
+	if err != nil {
+		t.Fatalf("batch result '%s' isn't a list", result)
+	}
+	return items
+}
+
+// expectItems checks the items of a batch reply, where each of want is
+// either the JSON result of the call or the code of its error
+func expectItems(t *testing.T, items []*fastjson.Value, want ...string) {
+	t.Helper()
+
+	if len(items) != len(want) {
+		t.Fatalf("got %d items instead of %d: %v", len(items), len(want), items)
+	}
+	for i, item := range items {
+		got := string(item.GetStringBytes("error", "code"))
+		if !item.Exists("error") {
+			got = item.Get("result").String()
+		}
+		if got != want[i] {
+			t.Errorf("item %d is %s instead of %s", i, item, want[i])
+		}
+	}
+}
+
+func TestAtomicBatch(t *testing.T) {
+	b := newFakeBroker()
+	var calls int32
+	startService(t, b, ConnectionOptions{}, batchContract(&calls))
+
+	// every call is checked before any is performed
+	items := sendBatch(t, b, `{"atomic": true, "calls": [
+		{"path": "inc", "argument": 1},
+		{"path": "inc", "argument": "one"}
+	]}`)
+	expectItems(t, items, "aborted", "type_mismatch")
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("inc was called %d times", n)
+	}
+
+	// the first failure aborts the rest
+	items = sendBatch(t, b, `{"atomic": true, "calls": [
+		{"path": "inc", "argument": 1, "token": "first"},
+		{"path": "fail"},
+		{"path": "inc", "argument": 2}
+	]}`)
+	expectItems(t, items, "2", "handler_failure", "aborted")
+	if token := string(items[0].GetStringBytes("token")); token != "first" {
+		t.Errorf("the first item has token %s", token)
+	}
+	if token := string(items[2].GetStringBytes("token")); token != "2" {
+		t.Errorf("the last item has token %s", token)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("inc was called %d times", n)
+	}
+}
+
+func TestBatchPartialFailure(t *testing.T) {
+	b := newFakeBroker()
+	var calls int32
+	startService(t, b, ConnectionOptions{}, batchContract(&calls))
+
+	items := sendBatch(t, b, `{"calls": [
+		{"path": "inc", "argument": 1},
+		{"path": "fail"},
+		{"path": "inc", "argument": "one"},
+		{"path": "nothing"},
+		{"argument": 1},
+		{"path": "inc", "argument": 3}
+	]}`)
+	expectItems(t, items, "2", "handler_failure", "type_mismatch", "unknown_topic", "bad_argument", "4")
+}
+
+func TestBatchAsync(t *testing.T) {
+	b := newFakeBroker()
+	var calls int32
+	startService(t, b, ConnectionOptions{}, batchContract(&calls))
+
+	items := sendBatch(t, b, `{"calls": [
+		{"path": "double", "argument": 2},
+		{"path": "inc", "argument": 1},
+		{"path": "double", "argument": "two"}
+	]}`)
+	expectItems(t, items, "4", "2", "type_mismatch")
+
+	items = sendBatch(t, b, `{"atomic": true, "calls": [
+		{"path": "inc", "argument": 1},
+		{"path": "double", "argument": 2}
+	]}`)
+	expectItems(t, items, "aborted", "bad_argument")
+}
+
+func TestEmptyBatch(t *testing.T) {
+	b := newFakeBroker()
+	var calls int32
+	startService(t, b, ConnectionOptions{}, batchContract(&calls))
+
+	expectItems(t, sendBatch(t, b, `{"calls": []}`))
+	expectItems(t, sendBatch(t, b, `{"atomic": true, "calls": []}`))
+
+	peer, replies := b.peer("_reply/r")
+	peer.Publish(mqtt.Message{
+		Topic:   mqtt.Topic("_batch/things/svc"),
+		Payload: []byte(`{"version": 2, "topic": "r", "token": "b", "argument": {"atomic": true}}`),
+	})
+	expectReplyCode(t, replies, "bad_argument")
+}
+
+func TestBatchRateLimit(t *testing.T) {
+	b := newFakeBroker()
+	var calls int32
+	startService(t, b, ConnectionOptions{}, batchContract(&calls))
+	cl := startClient(t, b, ConnectionOptions{})
+
+	// aborted calls don't use up tokens
+	items := sendBatch(t, b, `{"atomic": true, "calls": [
+		{"path": "ping"},
+		{"path": "inc", "argument": "one"}
+	]}`)
+	expectItems(t, items, "aborted", "type_mismatch")
+
+	// the calls of a batch share the tokens of their callable
+	items = sendBatch(t, b, `{"atomic": true, "calls": [
+		{"path": "ping"},
+		{"path": "ping"}
+	]}`)
+	expectItems(t, items, "aborted", "rate_limited")
+
+	expectCalls(t, cl, false, true)
+
+	items = sendBatch(t, b, `{"calls": [{"path": "ping"}]}`)
+	expectItems(t, items, "rate_limited")
+}
@@ -0,0 +1,327 @@
+package potoo
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/valyala/fastjson"
+)
+
+// fakeBroker is an in-memory MQTT broker which delivers the messages of
+// each client in order
+type fakeBroker struct {
+	sync.Mutex
+	clients  []*fakeClient
+	retained map[string][]byte
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{retained: make(map[string][]byte)}
+}
+
+type fakeClient struct {
+	b    *fakeBroker
+	conf *mqtt.ConnectConfig
+	subs map[string]bool
+	up   bool
+
+	queue chan mqtt.Message
+}
+
+func (b *fakeBroker) client() *fakeClient {
+	c := &fakeClient{b: b, subs: make(map[string]bool)}
+	b.Lock()
+	b.clients = append(b.clients, c)
+	b.Unlock()
+	return c
+}
+
+// peer returns a connected client whose messages arrive on the returned
+// channel, for playing the other side of the protocol by hand
+func (b *fakeBroker) peer(filters ...string) (*fakeClient, <-chan mqtt.Message) {
+	messages := make(chan mqtt.Message, 256)
+	c := b.client()
+	c.Connect(&mqtt.ConnectConfig{OnMessage: messages, OnDisconnect: make(chan error, 1)})
+	for _, filter := range filters {
+		c.Subscribe(mqtt.Topic(filter))
+	}
+	return c, messages
+}
+
+func topicMatches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(t) || (f[i] != "+" && f[i] != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func (c *fakeClient) Connect(conf *mqtt.ConnectConfig) error {
+	c.b.Lock()
+	var kicked []*fakeClient
+	for _, other := range c.b.clients {
+		if other != c && other.up && conf.ClientID != "" && other.conf.ClientID == conf.ClientID {
+			kicked = append(kicked, other)
+		}
+	}
+	c.conf = conf.Copy()
+	c.subs = make(map[string]bool)
+	c.up = true
+	c.queue = make(chan mqtt.Message, 1024)
+	go c.deliver(c.queue, c.conf.OnMessage)
+	c.b.Unlock()
+
+	for _, other := range kicked {
+		other.drop()
+	}
+	return nil
+}
+
+func (c *fakeClient) deliver(queue <-chan mqtt.Message, to chan<- mqtt.Message) {
+	for msg := range queue {
+		to <- msg
+	}
+}
+
+func (c *fakeClient) Publish(m mqtt.Message) {
+	c.b.Lock()
+	up := c.up
+	c.b.Unlock()
+	if up {
+		c.b.publish(*m.Copy())
+	}
+}
+
+func (b *fakeBroker) publish(m mqtt.Message) {
+	b.Lock()
+	defer b.Unlock()
+
+	if m.Retain {
+		if len(m.Payload) == 0 {
+			delete(b.retained, string(m.Topic))
+		} else {
+			b.retained[string(m.Topic)] = m.Payload
+		}
+	}
+	for _, c := range b.clients {
+		if !c.up {
+			continue
+		}
+		for filter := range c.subs {
+			if topicMatches(filter, string(m.Topic)) {
+				c.queue <- mqtt.Message{Topic: m.Topic, Payload: m.Payload, Retain: false}
+				break
+			}
+		}
+	}
+}
+
+// subscribed tells if any client is subscribed to filter
+func (b *fakeBroker) subscribed(filter string) bool {
+	b.Lock()
+	defer b.Unlock()
+	for _, c := range b.clients {
+		if c.up && c.subs[filter] {
+			return true
+		}
+	}
+	return false
+}
+
+// retainedValue returns the retained message on topic
+func (b *fakeBroker) retainedValue(topic string) ([]byte, bool) {
+	b.Lock()
+	defer b.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+func (c *fakeClient) Subscribe(filter mqtt.Topic) {
+	c.b.Lock()
+	defer c.b.Unlock()
+
+	if !c.up {
+		return
+	}
+	c.subs[string(filter)] = true
+	for topic, payload := range c.b.retained {
+		if topicMatches(string(filter), topic) {
+			c.queue <- mqtt.Message{Topic: mqtt.Topic(topic), Payload: payload, Retain: true}
+		}
+	}
+}
+
+func (c *fakeClient) Unsubscribe(filter mqtt.Topic) {
+	c.b.Lock()
+	defer c.b.Unlock()
+	delete(c.subs, string(filter))
+}
+
+func (c *fakeClient) DisconnectWithWill() {
+	c.Publish(c.conf.WillMessage)
+	c.Disconnect()
+}
+
+func (c *fakeClient) Disconnect() {
+	c.b.Lock()
+	defer c.b.Unlock()
+	if c.up {
+		c.up = false
+		close(c.queue)
+	}
+}
+
+// drop simulates a lost connection: the will is published and the client
+// is told that it has been disconnected
+func (c *fakeClient) drop() {
+	c.b.Lock()
+	if !c.up {
+		c.b.Unlock()
+		return
+	}
+	c.up = false
+	close(c.queue)
+	will := c.conf.WillMessage
+	onDisconnect := c.conf.OnDisconnect
+	c.b.Unlock()
+
+	if will.Topic != nil {
+		c.b.publish(*will.Copy())
+	}
+	onDisconnect <- errLostConnection
+	close(onDisconnect)
+}
+
+var errLostConnection = errors.New("connection lost")
+
+// publishContract publishes the contract of things/svc on behalf of a
+// service which is played by hand
+func (c *fakeClient) publishContract(contract contracts.Contract) {
+	c.publishContractAt("svc", contract)
+}
+
+func (c *fakeClient) publishContractAt(service string, contract contracts.Contract) {
+	var a fastjson.Arena
+	c.Publish(mqtt.Message{
+		Topic:   mqtt.JoinTopics(mqtt.Topic("_contract/things"), mqtt.Topic(service)),
+		Payload: contracts.Encode(&a, contract).MarshalTo(nil),
+		Retain:  true,
+	})
+}
+
+// reply replies to a call message with the given kind of reply (see
+// appendReplyHead) and JSON payload
+func (c *fakeClient) reply(call mqtt.Message, kind string, payload string) {
+	h := parseCallMessage(call.Payload)
+	buf := appendReplyHead(nil, h.version, h.token, kind, nil)
+	buf = append(buf, payload...)
+	buf = appendReplyTail(buf, h.version)
+	c.Publish(mqtt.Message{
+		Topic:   mqtt.JoinTopics(mqtt.Topic("_reply"), mqtt.Topic(h.replyTopic)),
+		Payload: buf,
+	})
+}
+
+// startConnection runs the loop of a connection until the end of the test
+func startConnection(t *testing.T, b *fakeBroker, opts ConnectionOptions) (*Connection, *fakeClient) {
+	t.Helper()
+
+	client := b.client()
+	opts.MqttClient = client
+	if opts.Root == nil {
+		opts.Root = mqtt.Topic("things")
+	}
+	if opts.CallTimeout == 0 {
+		opts.CallTimeout = 2 * time.Second
+	}
+	conn := New(&opts)
+	err := conn.Connect()
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+
+	exit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := conn.Loop(exit)
+		if err != nil {
+			t.Logf("loop of %s finished with %s", string(conn.serviceTopic(nil)), err)
+		}
+	}()
+	t.Cleanup(func() {
+		close(exit)
+		<-done
+	})
+	return conn, client
+}
+
+// startService starts a service with the given contract at things/svc
+func startService(t *testing.T, b *fakeBroker, opts ConnectionOptions, contract contracts.Contract) *Connection {
+	t.Helper()
+
+	if opts.ServiceRoot == nil {
+		opts.ServiceRoot = mqtt.Topic("svc")
+	}
+	conn, _ := startConnection(t, b, opts)
+	err := conn.UpdateContract(contract)
+	if err != nil {
+		t.Fatalf("unable to update contract: %s", err)
+	}
+	return conn
+}
+
+// startClient starts a client which knows the contract of things/svc
+func startClient(t *testing.T, b *fakeBroker, opts ConnectionOptions) *Connection {
+	t.Helper()
+
+	opts.DiscoverServices = true
+	conn, _ := startConnection(t, b, opts)
+	eventually(t, "the client knows the service", func() bool {
+		_, ok := conn.Service(mqtt.Topic("svc"))
+		return ok
+	})
+	return conn
+}
+
+// eventually waits until cond is true, and fails the test if it takes
+// too long
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// receive waits for a message on one of the topics matching filter
+func receive(t *testing.T, messages <-chan mqtt.Message, filter string) mqtt.Message {
+	t.Helper()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case msg := <-messages:
+			if topicMatches(filter, string(msg.Topic)) {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a message on %s", filter)
+		}
+	}
+}
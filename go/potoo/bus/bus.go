@@ -4,12 +4,18 @@ import (
 	"sync"
 	"time"
 
+	"github.com/dexterlb/potoo/go/potoo/logging"
 	"github.com/valyala/fastjson"
 )
 
 type RetHandler func(*fastjson.Arena, *fastjson.Value) *fastjson.Value
 type Handler func(*fastjson.Value)
 
+// ErrRetHandler is like RetHandler, but can fail. The error is sent back
+// to the caller. If it has a `Code() string` method, its result is used as
+// the error code in the reply.
+type ErrRetHandler func(*fastjson.Arena, *fastjson.Value) (*fastjson.Value, error)
+
 type Bus interface {
 	Send(*fastjson.Value)
 	Subscribe(Handler) int
@@ -26,6 +32,7 @@ type Options struct {
 	OnLastUnsubscribed func()
 	OnSubscribed       func()
 	OnUnsubscribed     func()
+	Logger             logging.Logger // defaults to logging.Nop
 }
 
 type handlerSet struct {
@@ -88,6 +95,8 @@ func (h *handlerSet) broadcast(lock sync.Locker, v *fastjson.Value) {
 }
 
 func (h *handlerSet) sendToAll(v *fastjson.Value) {
+	// the payload isn't logged, since buses may broadcast very often
+	logging.Or(h.opts.Logger).Debug("bus broadcast", "handlers", len(h.Handlers))
 	for _, handler := range h.Handlers {
 		handler(v)
 	}
@@ -121,6 +130,7 @@ func subscribeToBus(b busInternals, handler Handler) int {
 
 	b.handlers().Handlers[b.handlers().N] = handler
 	b.handlers().N += 1
+	logging.Or(b.opts().Logger).Debug("bus subscribed", "handlers", len(b.handlers().Handlers))
 
 	return b.handlers().N - 1
 }
@@ -134,6 +144,7 @@ func unsubscribeFromBus(b busInternals, i int) {
 	}
 
 	delete(b.handlers().Handlers, i)
+	logging.Or(b.opts().Logger).Debug("bus unsubscribed", "handlers", len(b.handlers().Handlers))
 	notify(b.opts().OnUnsubscribed)
 
 	if len(b.handlers().Handlers) == 0 {
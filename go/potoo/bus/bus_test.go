@@ -0,0 +1,67 @@
+package bus
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dexterlb/potoo/go/potoo/logging"
+	"github.com/valyala/fastjson"
+)
+
+type recorder struct {
+	lines []string
+}
+
+func (r *recorder) log(level logging.Level, msg string, args []interface{}) {
+	r.lines = append(r.lines, logging.Format(level, msg, args...))
+}
+
+func (r *recorder) Debug(msg string, args ...interface{}) { r.log(logging.LevelDebug, msg, args) }
+func (r *recorder) Info(msg string, args ...interface{})  { r.log(logging.LevelInfo, msg, args) }
+func (r *recorder) Warn(msg string, args ...interface{})  { r.log(logging.LevelWarn, msg, args) }
+func (r *recorder) Error(msg string, args ...interface{}) { r.log(logging.LevelError, msg, args) }
+
+func TestBusLogging(t *testing.T) {
+	r := &recorder{}
+	b := NewStringBusWithOpts("", &Options{Logger: r})
+
+	sub := b.Subscribe(func(v *fastjson.Value) {})
+	b.SendV("secret")
+	b.Unsubscribe(sub)
+
+	want := []string{
+		"DEBUG bus subscribed handlers=1",
+		"DEBUG bus broadcast handlers=1",
+		"DEBUG bus unsubscribed handlers=0",
+	}
+	if fmt.Sprint(r.lines) != fmt.Sprint(want) {
+		t.Errorf("logged %q instead of %q", r.lines, want)
+	}
+	for _, line := range r.lines {
+		if strings.Contains(line, "secret") {
+			t.Errorf("the payload is logged in %q", line)
+		}
+	}
+}
+
+func TestBusDeduplicate(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		b := NewIntBusWithOpts(0, &Options{Deduplicate: dedup})
+		var got []int
+		b.Subscribe(func(v *fastjson.Value) {
+			got = append(got, v.GetInt())
+		})
+		for _, n := range []int{1, 1, 2, 2, 1} {
+			b.SendV(n)
+		}
+
+		want := "[1 1 2 2 1]"
+		if dedup {
+			want = "[1 2 1]"
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("bus with Deduplicate=%v sent %v instead of %s", dedup, got, want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package bus
+
+import (
+	"context"
+
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/valyala/fastjson"
+)
+
+// CtxRetHandler is like ErrRetHandler, but receives a context which is
+// cancelled when the connection stops or the deadline of the callable
+// passes. The context also carries a CallInfo.
+type CtxRetHandler func(context.Context, *fastjson.Arena, *fastjson.Value) (*fastjson.Value, error)
+
+// CallInfo describes the call which is being handled
+type CallInfo struct {
+	Topic      mqtt.Topic // the topic on which the call arrived
+	Path       mqtt.Topic // the path of the callable within the contract
+	ReplyTopic mqtt.Topic // the topic to which the reply is sent
+	Token      string
+
+	Caller         string // the identity of the caller, if it has sent one
+	CallerVerified bool   // the identity of the caller has been verified
+}
+
+type callInfoKey struct{}
+
+func WithCallInfo(ctx context.Context, info *CallInfo) context.Context {
+	return context.WithValue(ctx, callInfoKey{}, info)
+}
+
+// CallInfoFrom returns the CallInfo from a handler context
+func CallInfoFrom(ctx context.Context) (*CallInfo, bool) {
+	info, ok := ctx.Value(callInfoKey{}).(*CallInfo)
+	return info, ok
+}
+
+// StreamHandler handles a call by emitting a sequence of values of the
+// callable's return type, and returns when the sequence is over. Each
+// value is marshalled before emit returns, so the arena may be reused
+// between emits. emit fails if the value has the wrong type or the
+// connection is dead.
+type StreamHandler func(ctx context.Context, arena *fastjson.Arena, arg *fastjson.Value, emit func(*fastjson.Value) error) error
@@ -0,0 +1,305 @@
+package potoo
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/dexterlb/potoo/go/potoo/codec"
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/logging"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+var errConnectionDead = errors.New("connection is dead")
+
+// Call performs a call to the remote callable at topic (which is relative
+// to the connection root, e.g. "<service root>/<path>") and waits for its
+// result. The callable must be present in a contract obtained via
+// GetContracts. The returned value is owned by the caller.
+//
+// The call fails when ctx is done or when CallTimeout (if nonzero) expires.
+func (c *Connection) Call(ctx context.Context, topic mqtt.Topic, argument *fastjson.Value) (*fastjson.Value, error) {
+	if c.opts.CallTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.CallTimeout)
+		defer cancel()
+	}
+
+	replies := make(chan []byte, 1)
+	call := outgoingCall{
+		topic:    topic,
+		argument: argument,
+		token:    randomString(16),
+		replies:  replies,
+	}
+
+	defer c.forgetPendingCall(call.token)
+
+	acc, err := c.startCall(call)
+	if err != nil {
+		return nil, err
+	}
+	if acc.stream {
+		return nil, fmt.Errorf("cannot call '%s': callable is streaming, use CallStream", string(topic))
+	}
+	if acc.void {
+		return nil, nil
+	}
+
+	select {
+	case data := <-replies:
+		retval, err := parseReply(data, acc.encoding)
+		if err != nil {
+			return nil, fmt.Errorf("call to '%s' failed: %w", string(topic), err)
+		}
+		err = types.TypeCheck(retval, acc.retval)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' returned value of wrong type: %s", string(topic), err)
+		}
+		return retval, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("call to '%s' failed: %w", string(topic), ctx.Err())
+	case <-c.thatsAllFolks:
+		return nil, errConnectionDead
+	}
+}
+
+// startCall hands the call to the connection loop and waits for it to be
+// published
+func (c *Connection) startCall(call outgoingCall) (callAcceptance, error) {
+	accepted := make(chan callAcceptance, 1)
+	call.accepted = accepted
+
+	c.deathMutex.Lock()
+	if c.dead {
+		c.deathMutex.Unlock()
+		return callAcceptance{}, errConnectionDead
+	}
+	c.outgoingCalls <- call
+	c.deathMutex.Unlock()
+
+	var acc callAcceptance
+	select {
+	case acc = <-accepted:
+	case <-c.thatsAllFolks:
+		return acc, errConnectionDead
+	}
+	if acc.err != nil {
+		return acc, fmt.Errorf("cannot call '%s': %s", string(call.topic), acc.err)
+	}
+	return acc, nil
+}
+
+// GetContracts subscribes to the contracts of all services matching topic
+// (which may contain wildcards, e.g. "#").
+func (c *Connection) GetContracts(topic mqtt.Topic) {
+	c.clientSubscribe(c.clientTopic(mqtt.Topic("_contract"), topic))
+}
+
+type outgoingCall struct {
+	topic    mqtt.Topic
+	argument *fastjson.Value
+	token    string
+	replies  chan<- []byte
+	accepted chan<- callAcceptance
+}
+
+type callAcceptance struct {
+	err      error
+	retval   types.Type
+	encoding codec.Codec // of the results
+	void     bool
+	stream   bool
+}
+
+type pendingCall struct {
+	replies  chan<- []byte
+	stream   bool
+	encoding codec.Codec // of the replies
+}
+
+type remoteCallable struct {
+	service  string
+	callable contracts.Callable
+}
+
+func (c *Connection) handleOutgoingCall(call outgoingCall) {
+	c.remoteMutex.Lock()
+	rc, ok := c.remoteCallables[string(mqtt.JoinTopics(call.topic))]
+	c.remoteMutex.Unlock()
+	if !ok {
+		call.accepted <- callAcceptance{err: fmt.Errorf("no such callable in known contracts")}
+		return
+	}
+
+	err := types.TypeCheck(call.argument, rc.callable.Argument)
+	if err != nil {
+		call.accepted <- callAcceptance{err: fmt.Errorf("argument has wrong type: %s", err)}
+		return
+	}
+
+	encoding := rc.callable.Encoding
+	if c.opts.ProtocolVersion >= ProtocolV2 {
+		encoding = nil // values embedded in JSON objects are always JSON
+	}
+	stream := rc.callable.IsStream()
+	_, void := rc.callable.Retval.T.(*types.TVoid)
+	if !void || stream {
+		c.pendingMutex.Lock()
+		c.pendingCalls[call.token] = pendingCall{replies: call.replies, stream: stream, encoding: encoding}
+		c.pendingMutex.Unlock()
+	}
+
+	c.log.Debug("calling", logging.KeyTopic, string(call.topic), logging.KeyToken, call.token)
+	callTopic := c.clientTopic(mqtt.Topic("_call"), call.topic)
+	h := callHeader{
+		replyTopic: c.replyTopic,
+		token:      []byte(call.token),
+		argument:   codec.Or(encoding).Marshal(nil, call.argument),
+	}
+	c.identifyCall(callTopic, &h)
+	if c.opts.ProtocolVersion >= ProtocolV2 {
+		c.msgBuf = appendCallObject(c.msgBuf[0:0], h)
+	} else {
+		c.msgBuf = append(c.msgBuf[0:0], h.replyTopic...)
+		c.msgBuf = append(c.msgBuf, ' ')
+		c.msgBuf = append(c.msgBuf, h.token...)
+		c.msgBuf = append(c.msgBuf, ' ')
+		if h.identity != nil {
+			c.msgBuf = append(c.msgBuf, callerField(h)...)
+			c.msgBuf = append(c.msgBuf, ' ')
+		}
+		c.msgBuf = append(c.msgBuf, h.argument...)
+	}
+	c.publish(mqtt.Message{Topic: callTopic, Payload: c.msgBuf})
+
+	call.accepted <- callAcceptance{retval: rc.callable.Retval, encoding: encoding, void: void, stream: stream}
+}
+
+func (c *Connection) handleReply(msg mqtt.Message) {
+	token, data := parseReplyMessage(msg.Payload)
+
+	c.pendingMutex.Lock()
+	pending, ok := c.pendingCalls[string(token)]
+	if kind, _ := splitReply(data, pending.encoding); !pending.stream || kind != "chunk" {
+		delete(c.pendingCalls, string(token))
+	}
+	c.pendingMutex.Unlock()
+
+	if !ok {
+		// late reply to a call that has timed out (or someone else's reply)
+		return
+	}
+
+	select {
+	case pending.replies <- append([]byte(nil), data...):
+	default:
+		if pending.stream {
+			// the consumer can't keep up, so we end the stream
+			c.forgetPendingCall(string(token))
+			close(pending.replies)
+		}
+	}
+}
+
+// parseReply parses the part of the reply after the token, which is
+// either a result or "error <error object>" (which is always JSON)
+func parseReply(data []byte, enc codec.Codec) (*fastjson.Value, error) {
+	kind, value := splitReply(data, enc)
+	if kind == "error" {
+		v, err := fastjson.ParseBytes(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse reply: %s", err)
+		}
+		return nil, decodeCallError(v)
+	}
+	if kind != "result" {
+		return nil, fmt.Errorf("unable to parse reply: unexpected '%s' reply", kind)
+	}
+
+	v, err := codec.Or(enc).Unmarshal(nil, nil, value)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse reply: %s", err)
+	}
+	return v, nil
+}
+
+func (c *Connection) forgetPendingCall(token string) {
+	c.pendingMutex.Lock()
+	delete(c.pendingCalls, token)
+	c.pendingMutex.Unlock()
+}
+
+// clientSubscribe subscribes to filter, or remembers it until the connection
+// is established. Subscriptions are reference counted.
+func (c *Connection) clientSubscribe(filter mqtt.Topic) {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	c.clientSubs[string(filter)]++
+	if c.clientSubs[string(filter)] == 1 && c.mqttUp {
+		c.opts.MqttClient.Subscribe(filter)
+	}
+}
+
+func (c *Connection) clientUnsubscribe(filter mqtt.Topic) {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	if c.clientSubs[string(filter)] == 0 {
+		return
+	}
+	c.clientSubs[string(filter)]--
+	if c.clientSubs[string(filter)] == 0 {
+		delete(c.clientSubs, string(filter))
+		if c.mqttUp {
+			c.opts.MqttClient.Unsubscribe(filter)
+		}
+	}
+}
+
+func (c *Connection) restoreClientSubscriptions() {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	c.mqttUp = true
+	for filter := range c.clientSubs {
+		c.opts.MqttClient.Subscribe(mqtt.Topic(filter))
+	}
+}
+
+// goOffline marks the connection as disconnected and reports whether it
+// was connected before
+func (c *Connection) goOffline() bool {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	wasUp := c.mqttUp
+	c.mqttUp = false
+	return wasUp
+}
+
+func (c *Connection) online() bool {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	return c.mqttUp
+}
+
+func randomString(n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(fmt.Errorf("cannot read random bytes: %s", err))
+	}
+	for i := range b {
+		b[i] = letters[int(b[i])%len(letters)]
+	}
+	return string(b)
+}
@@ -0,0 +1,141 @@
+package potoo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+func TestCallTokens(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"echo": contracts.Callable{
+			Argument: types.Int(),
+			Retval:   types.Int(),
+			Async:    true,
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				// later calls finish first
+				time.Sleep(time.Duration(20-arg.GetInt()) * time.Millisecond)
+				return arg
+			},
+		},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := cl.Call(context.Background(), mqtt.Topic("svc/echo"), q.Int(i))
+			if err != nil {
+				t.Errorf("call %d failed: %s", i, err)
+				return
+			}
+			if r.GetInt() != i {
+				t.Errorf("call %d got the result of call %s", i, r)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCallLateReply(t *testing.T) {
+	b := newFakeBroker()
+	svc, calls := b.peer("_call/things/svc/#")
+	svc.publishContract(contracts.Map{
+		"slow": contracts.Callable{Argument: types.Int(), Retval: types.String()},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := cl.Call(ctx, mqtt.Topic("svc/slow"), q.Int(1))
+	if err == nil {
+		t.Fatalf("call succeeded without a reply")
+	}
+	late := receive(t, calls, "_call/things/svc/slow")
+
+	result := make(chan error, 1)
+	go func() {
+		r, err := cl.Call(context.Background(), mqtt.Topic("svc/slow"), q.Int(2))
+		if err == nil && string(r.GetStringBytes()) != "second" {
+			err = fmt.Errorf("got the result %s", r)
+		}
+		result <- err
+	}()
+	call := receive(t, calls, "_call/things/svc/slow")
+
+	svc.reply(late, "result", `"first"`)
+	svc.reply(call, "result", `"second"`)
+	err = <-result
+	if err != nil {
+		t.Errorf("the call after a timed out call failed: %s", err)
+	}
+}
+
+func TestCallVoid(t *testing.T) {
+	b := newFakeBroker()
+	called := make(chan int64, 1)
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"set": contracts.Callable{
+			Argument: types.Int(),
+			Retval:   types.Void(),
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				called <- arg.GetInt64()
+				return nil
+			},
+		},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	r, err := cl.Call(context.Background(), mqtt.Topic("svc/set"), q.Int(42))
+	if r != nil || err != nil {
+		t.Errorf("void call returned (%v, %v) instead of (nil, nil)", r, err)
+	}
+	select {
+	case n := <-called:
+		if n != 42 {
+			t.Errorf("void callable was called with %d instead of 42", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("void callable wasn't called")
+	}
+}
+
+func TestCallTypeCheck(t *testing.T) {
+	b := newFakeBroker()
+	svc, calls := b.peer("_call/things/svc/#")
+	svc.publishContract(contracts.Map{
+		"get": contracts.Callable{Argument: types.Null(), Retval: types.Int()},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	_, err := cl.Call(context.Background(), mqtt.Topic("svc/get"), q.String("foo"))
+	if err == nil {
+		t.Errorf("call with an argument of the wrong type succeeded")
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := cl.Call(context.Background(), mqtt.Topic("svc/get"), q.Json(nil))
+		result <- err
+	}()
+	svc.reply(receive(t, calls, "_call/things/svc/get"), "result", `"not an int"`)
+	if err := <-result; err == nil {
+		t.Errorf("call which returned a value of the wrong type succeeded")
+	}
+
+	_, err = cl.Call(context.Background(), mqtt.Topic("svc/nothing"), q.Json(nil))
+	if err == nil {
+		t.Errorf("call to a callable which isn't in the contract succeeded")
+	}
+}
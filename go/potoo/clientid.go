@@ -0,0 +1,127 @@
+package potoo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+)
+
+// ErrClientIDCollision is returned by Loop when another MQTT client uses
+// our client ID and wins the collision, so that the two don't keep kicking
+// each other off the broker
+var ErrClientIDCollision = errors.New("another MQTT client is using our client ID")
+
+// brokers are only required to accept client IDs of up to 23 bytes
+const maxClientIDLength = 23
+
+// makeClientID returns the MQTT client ID of the connection, and whether
+// it is unique. The ID is ConnectionOptions.ClientID or the one configured
+// in the MQTT client, if any. Otherwise, services get a stable ID derived
+// from the service root and the instance ID (so that their sessions
+// survive restarts), while plain clients get a unique one.
+func (c *Connection) makeClientID() (string, bool) {
+	if c.opts.ClientID != "" {
+		return c.opts.ClientID, false
+	}
+	if p, ok := c.opts.MqttClient.(mqtt.ClientIDProvider); ok {
+		if id := p.ConfiguredClientID(); id != "" {
+			return id, false
+		}
+	}
+
+	if len(c.opts.ServiceRoot) == 0 {
+		return "potoo-" + c.session, true
+	}
+
+	instance := c.opts.InstanceID
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	parts := []string{"potoo", string(mqtt.JoinTopics(c.opts.Root, c.opts.ServiceRoot)), instance}
+	for i := range parts {
+		parts[i] = sanitizeClientID(parts[i])
+	}
+	return shortenClientID(strings.Join(parts, "-")), false
+}
+
+// shortenClientID keeps the beginning of a long ID and replaces the rest
+// with a hash of the whole ID, so that it fits in maxClientIDLength
+func shortenClientID(id string) string {
+	if len(id) <= maxClientIDLength {
+		return id
+	}
+	sum := sha256.Sum256([]byte(id))
+	hash := hex.EncodeToString(sum[:])[:8]
+	return id[:maxClientIDLength-len(hash)-1] + "-" + hash
+}
+
+// sanitizeClientID replaces everything except letters, digits, dots and
+// underscores with underscores
+func sanitizeClientID(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// announceClientID publishes our session as the retained owner of our
+// client ID. Whoever connects with the same ID kicks us off the broker;
+// if we see their announcement after we reconnect, we know that our ID
+// is taken. Announcements seen on the first connection may be stale, so
+// they are ignored. Unique IDs can't collide, so they aren't announced
+// (which would leave retained garbage on the broker).
+func (c *Connection) announceClientID() {
+	if c.uniqueClientID {
+		return
+	}
+
+	if !c.watchingClientID {
+		c.watchingClientID = true
+		c.clientSubscribe(c.clientIDTopic)
+	}
+	c.checkingClientID = c.everConnected
+	c.everConnected = true
+
+	c.publish(mqtt.Message{
+		Topic:   c.clientIDTopic,
+		Payload: []byte(c.session),
+		Retain:  true,
+	})
+}
+
+// clearClientID removes our announcement when we shut down cleanly, so
+// that it isn't left on the broker
+func (c *Connection) clearClientID() {
+	if c.uniqueClientID || !c.everConnected {
+		return
+	}
+	c.publish(mqtt.Message{Topic: c.clientIDTopic, Retain: true})
+}
+
+func (c *Connection) handleClientIDAnnouncement(payload []byte) {
+	if string(payload) == c.session {
+		// everything retained before our announcement has been seen
+		c.checkingClientID = false
+		return
+	}
+	if !c.checkingClientID || len(payload) == 0 {
+		return
+	}
+
+	// both clients see each other's sessions, and the one with the
+	// greater session gives up
+	if string(payload) > c.session {
+		c.err(newError(ClientIDCollision, c.clientIDTopic, "%s, which will give up", ErrClientIDCollision))
+		return
+	}
+	c.err(newError(ClientIDCollision, c.clientIDTopic, "%s", ErrClientIDCollision))
+	c.fatalErr = ErrClientIDCollision
+}
@@ -0,0 +1,110 @@
+package potoo
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+)
+
+// configuredClient is an MQTT client with its own client ID setting
+type configuredClient struct {
+	*fakeClient
+	id string
+}
+
+func (c configuredClient) ConfiguredClientID() string {
+	return c.id
+}
+
+func TestClientIDs(t *testing.T) {
+	b := newFakeBroker()
+	longRoot := mqtt.Topic("a/very/long/service/root/which/needs/to/be/shortened")
+	tests := []struct {
+		name   string
+		opts   ConnectionOptions
+		want   string
+		unique bool
+	}{
+		{"explicit", ConnectionOptions{ClientID: "mine", MqttClient: configuredClient{b.client(), "wrapper"}}, "mine", false},
+		{"wrapper", ConnectionOptions{MqttClient: configuredClient{b.client(), "wrapper"}}, "wrapper", false},
+		{"empty wrapper", ConnectionOptions{ServiceRoot: mqtt.Topic("svc"), InstanceID: "x", MqttClient: configuredClient{b.client(), ""}}, "potoo-things_svc-x", false},
+		{"service", ConnectionOptions{ServiceRoot: mqtt.Topic("svc"), InstanceID: "x"}, "potoo-things_svc-x", false},
+		{"long service", ConnectionOptions{ServiceRoot: longRoot, InstanceID: "x"}, "potoo-things_a-", false},
+		{"client", ConnectionOptions{}, "potoo-", true},
+	}
+	for _, test := range tests {
+		opts := test.opts
+		opts.Root = mqtt.Topic("things")
+		if opts.MqttClient == nil {
+			opts.MqttClient = b.client()
+		}
+		c := New(&opts)
+		if !strings.HasPrefix(c.clientID, test.want) || c.uniqueClientID != test.unique {
+			t.Errorf("%s: got client ID %s (unique: %v)", test.name, c.clientID, c.uniqueClientID)
+		}
+		if test.opts.ClientID == "" && len(c.clientID) > maxClientIDLength {
+			t.Errorf("%s: derived client ID %s is too long", test.name, c.clientID)
+		}
+		if other, _ := New(&opts).makeClientID(); (other == c.clientID) == test.unique {
+			t.Errorf("%s: got %s and then %s", test.name, c.clientID, other)
+		}
+	}
+}
+
+func TestClientIDCollision(t *testing.T) {
+	b := newFakeBroker()
+	contract := contracts.Map{"name": q.StringConst("lamp")}
+	opts := ConnectionOptions{
+		InstanceID: "same",
+		Reconnect:  &ReconnectPolicy{MinDelay: 10 * time.Millisecond},
+	}
+
+	first := startService(t, b, opts, contract)
+	eventually(t, "the first service announces its client ID", func() bool {
+		session, _ := b.retainedValue(string(first.clientIDTopic))
+		return string(session) == first.session
+	})
+	second := startService(t, b, opts, contract)
+
+	winner, loser := first, second
+	if second.session < first.session {
+		winner, loser = second, first
+	}
+	select {
+	case <-loser.thatsAllFolks:
+	case <-winner.thatsAllFolks:
+		t.Fatalf("the connection with the smaller session gave up")
+	case <-time.After(2 * time.Second):
+		t.Fatalf("neither connection gave up")
+	}
+	eventually(t, "the winner owns the client ID", func() bool {
+		session, _ := b.retainedValue(string(winner.clientIDTopic))
+		return string(session) == winner.session && winner.online()
+	})
+	select {
+	case <-winner.thatsAllFolks:
+		t.Errorf("the winner gave up too")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClientIDShutdown(t *testing.T) {
+	b := newFakeBroker()
+	svc := startService(t, b, ConnectionOptions{InstanceID: "x"}, contracts.Map{"name": q.StringConst("lamp")})
+	eventually(t, "the service announces its client ID under the root", func() bool {
+		session, _ := b.retainedValue("_client/things/potoo_things_svc_x")
+		return string(session) == svc.session
+	})
+
+	if err := svc.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+	if session, ok := b.retainedValue("_client/things/potoo_things_svc_x"); ok {
+		t.Errorf("the announcement %s was left on the broker", session)
+	}
+}
@@ -0,0 +1,275 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/valyala/fastjson"
+)
+
+// cborCodec implements the JSON-compatible subset of CBOR (RFC 8949).
+// Byte strings aren't supported, and tags are ignored.
+type cborCodec struct{}
+
+const (
+	cborUint   = 0
+	cborNegint = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+func (cborCodec) Name() string { return "cbor" }
+
+func (cborCodec) Marshal(dst []byte, v *fastjson.Value) []byte {
+	switch v.Type() {
+	case fastjson.TypeNull:
+		return append(dst, 0xf6)
+	case fastjson.TypeFalse:
+		return append(dst, 0xf4)
+	case fastjson.TypeTrue:
+		return append(dst, 0xf5)
+	case fastjson.TypeNumber:
+		if n, ok := integer(v); ok {
+			if n >= 0 {
+				return cborHead(dst, cborUint, uint64(n))
+			}
+			return cborHead(dst, cborNegint, uint64(-(n + 1)))
+		}
+		if n, err := v.Uint64(); err == nil {
+			return cborHead(dst, cborUint, n)
+		}
+		dst = append(dst, 0xfb)
+		return appendUint(dst, math.Float64bits(v.GetFloat64()), 8)
+	case fastjson.TypeString:
+		s := v.GetStringBytes()
+		dst = cborHead(dst, cborText, uint64(len(s)))
+		return append(dst, s...)
+	case fastjson.TypeArray:
+		items := v.GetArray()
+		dst = cborHead(dst, cborArray, uint64(len(items)))
+		for _, item := range items {
+			dst = CBOR.Marshal(dst, item)
+		}
+		return dst
+	case fastjson.TypeObject:
+		o := v.GetObject()
+		dst = cborHead(dst, cborMap, uint64(o.Len()))
+		o.Visit(func(k []byte, item *fastjson.Value) {
+			dst = cborHead(dst, cborText, uint64(len(k)))
+			dst = append(dst, k...)
+			dst = CBOR.Marshal(dst, item)
+		})
+		return dst
+	default:
+		panic(fmt.Errorf("unknown fastjson type: %s", v.Type()))
+	}
+}
+
+func cborHead(dst []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(dst, major<<5|byte(n))
+	case n <= math.MaxUint8:
+		return appendUint(append(dst, major<<5|24), n, 1)
+	case n <= math.MaxUint16:
+		return appendUint(append(dst, major<<5|25), n, 2)
+	case n <= math.MaxUint32:
+		return appendUint(append(dst, major<<5|26), n, 4)
+	default:
+		return appendUint(append(dst, major<<5|27), n, 8)
+	}
+}
+
+func (cborCodec) Unmarshal(p *fastjson.Parser, a *fastjson.Arena, data []byte) (*fastjson.Value, error) {
+	d := newDecoder(a, data)
+	v, err := d.cbor()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cbor: %s", err)
+	}
+	if err := d.done(); err != nil {
+		return nil, fmt.Errorf("invalid cbor: %s", err)
+	}
+	return v, nil
+}
+
+// cborHead reads the major type and argument of the next item
+func (d *decoder) cborHead() (major byte, info byte, n uint64, indefinite bool, err error) {
+	b, err := d.need(1)
+	if err != nil {
+		return
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		n, err = d.uint(1 << (info - 24))
+	case info == cborIndefinite:
+		indefinite = true
+	default:
+		err = fmt.Errorf("reserved additional information %d at %d", info, d.pos-1)
+	}
+	return
+}
+
+func (d *decoder) cbor() (*fastjson.Value, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	start := d.pos
+	major, info, n, indefinite, err := d.cborHead()
+	if err != nil {
+		return nil, err
+	}
+	if indefinite && (major == cborUint || major == cborNegint || major == cborTag) {
+		return nil, fmt.Errorf("invalid indefinite length at %d", start)
+	}
+
+	switch major {
+	case cborUint:
+		return d.a.NewNumberString(strconv.FormatUint(n, 10)), nil
+	case cborNegint:
+		if n == math.MaxUint64 {
+			return d.a.NewNumberString("-18446744073709551616"), nil
+		}
+		return d.a.NewNumberString("-" + strconv.FormatUint(n+1, 10)), nil
+	case cborBytes:
+		return nil, fmt.Errorf("byte strings are not supported (at %d)", start)
+	case cborText:
+		s, err := d.cborText(n, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		return d.a.NewStringBytes(s), nil
+	case cborArray:
+		arr := d.a.NewArray()
+		for i := 0; indefinite || uint64(i) < n; i++ {
+			if indefinite && d.cborBreak() {
+				break
+			}
+			item, err := d.cbor()
+			if err != nil {
+				return nil, err
+			}
+			arr.SetArrayItem(i, item)
+		}
+		return arr, nil
+	case cborMap:
+		o := d.a.NewObject()
+		for i := uint64(0); indefinite || i < n; i++ {
+			if indefinite && d.cborBreak() {
+				break
+			}
+			kmajor, _, kn, kindefinite, err := d.cborHead()
+			if err != nil {
+				return nil, err
+			}
+			if kmajor != cborText {
+				return nil, fmt.Errorf("map key is not a text string (at %d)", d.pos)
+			}
+			key, err := d.cborText(kn, kindefinite)
+			if err != nil {
+				return nil, err
+			}
+			item, err := d.cbor()
+			if err != nil {
+				return nil, err
+			}
+			o.Set(string(key), item)
+		}
+		return o, nil
+	case cborTag:
+		return d.cbor()
+	default: // cborSimple
+		return d.cborSimple(info, n, start)
+	}
+}
+
+func (d *decoder) cborBreak() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == cborBreak {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *decoder) cborText(n uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		return d.need(n)
+	}
+
+	var s []byte
+	for !d.cborBreak() {
+		major, _, n, chunkIndefinite, err := d.cborHead()
+		if err != nil {
+			return nil, err
+		}
+		if major != cborText || chunkIndefinite {
+			return nil, fmt.Errorf("invalid text string chunk at %d", d.pos)
+		}
+		chunk, err := d.need(n)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, chunk...)
+	}
+	return s, nil
+}
+
+func (d *decoder) cborSimple(info byte, n uint64, start int) (*fastjson.Value, error) {
+	switch info {
+	case 20:
+		return d.a.NewFalse(), nil
+	case 21:
+		return d.a.NewTrue(), nil
+	case 22, 23: // null and undefined
+		return d.a.NewNull(), nil
+	case 25:
+		return cborFloat(d.a, halfToFloat64(uint16(n)))
+	case 26:
+		return cborFloat(d.a, float64(math.Float32frombits(uint32(n))))
+	case 27:
+		return cborFloat(d.a, math.Float64frombits(n))
+	default:
+		return nil, fmt.Errorf("unsupported simple value at %d", start)
+	}
+}
+
+func cborFloat(a *fastjson.Arena, f float64) (*fastjson.Value, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("%v can't be represented in JSON", f)
+	}
+	return a.NewNumberFloat64(f), nil
+}
+
+func halfToFloat64(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,136 @@
+// Package codec implements the encodings of value and call payloads.
+// Payloads are always decoded into fastjson values, so that they can be
+// type checked and handled in the same way regardless of the encoding.
+package codec
+
+import (
+	"fmt"
+
+	"github.com/valyala/fastjson"
+)
+
+// maxDepth limits the nesting of decoded binary values
+const maxDepth = 300
+
+// Codec is a payload encoding, as named in the "encoding" field of schemas
+type Codec interface {
+	Name() string
+
+	// Marshal appends the encoding of v to dst
+	Marshal(dst []byte, v *fastjson.Value) []byte
+
+	// Unmarshal decodes data. The result may refer to p, a and data.
+	// If p or a is nil, a new one is used.
+	Unmarshal(p *fastjson.Parser, a *fastjson.Arena, data []byte) (*fastjson.Value, error)
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	CBOR    Codec = cborCodec{}
+	MsgPack Codec = msgpackCodec{}
+)
+
+// ByName returns the codec with the given name
+func ByName(name string) (Codec, error) {
+	switch name {
+	case "", "json":
+		return JSON, nil
+	case "cbor":
+		return CBOR, nil
+	case "msgpack":
+		return MsgPack, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding: %s", name)
+	}
+}
+
+// Or returns c, or JSON if c is nil
+func Or(c Codec) Codec {
+	if c == nil {
+		return JSON
+	}
+	return c
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(dst []byte, v *fastjson.Value) []byte {
+	return v.MarshalTo(dst)
+}
+
+func (jsonCodec) Unmarshal(p *fastjson.Parser, a *fastjson.Arena, data []byte) (*fastjson.Value, error) {
+	if p == nil {
+		return fastjson.ParseBytes(data)
+	}
+	return p.ParseBytes(data)
+}
+
+// integer tells if a number is an integer, and returns it as one
+func integer(v *fastjson.Value) (int64, bool) {
+	n, err := v.Int64()
+	return n, err == nil
+}
+
+// decoder holds the state common to the binary decoders
+type decoder struct {
+	a     *fastjson.Arena
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (d *decoder) need(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("unexpected end of data at %d", d.pos)
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *decoder) uint(size int) (uint64, error) {
+	b, err := d.need(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, x := range b {
+		n = n<<8 | uint64(x)
+	}
+	return n, nil
+}
+
+func (d *decoder) enter() error {
+	d.depth++
+	if d.depth > maxDepth {
+		return fmt.Errorf("value is nested too deeply")
+	}
+	return nil
+}
+
+func (d *decoder) leave() {
+	d.depth--
+}
+
+func (d *decoder) done() error {
+	if d.pos != len(d.data) {
+		return fmt.Errorf("unexpected data after the value at %d", d.pos)
+	}
+	return nil
+}
+
+func newDecoder(a *fastjson.Arena, data []byte) *decoder {
+	if a == nil {
+		a = &fastjson.Arena{}
+	}
+	return &decoder{a: a, data: data}
+}
+
+func appendUint(dst []byte, n uint64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		dst = append(dst, byte(n>>(8*uint(i))))
+	}
+	return dst
+}
@@ -0,0 +1,220 @@
+package codec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fastjson"
+)
+
+var binaryCodecs = []Codec{CBOR, MsgPack}
+
+func manyKeys(n int) string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = `"k` + strings.Repeat("x", i) + `":` + strings.Repeat("[", i%3) + "1" + strings.Repeat("]", i%3)
+	}
+	return "{" + strings.Join(keys, ",") + "}"
+}
+
+func manyItems(n int) string {
+	return "[" + strings.TrimSuffix(strings.Repeat("1,", n), ",") + "]"
+}
+
+func quoted(s string) string {
+	return `"` + s + `"`
+}
+
+// roundTrips are JSON values which must survive encoding and decoding,
+// along with their JSON form after that (if it differs)
+var roundTrips = []struct {
+	in  string
+	out string
+}{
+	{in: "null"},
+	{in: "true"},
+	{in: "false"},
+
+	// the boundaries of each integer width
+	{in: "0"},
+	{in: "23"},
+	{in: "24"},
+	{in: "127"},
+	{in: "128"},
+	{in: "255"},
+	{in: "256"},
+	{in: "65535"},
+	{in: "65536"},
+	{in: "4294967295"},
+	{in: "4294967296"},
+	{in: "9223372036854775807"},
+	{in: "9223372036854775808"},
+	{in: "18446744073709551615"},
+	{in: "-1"},
+	{in: "-24"},
+	{in: "-25"},
+	{in: "-32"},
+	{in: "-33"},
+	{in: "-128"},
+	{in: "-129"},
+	{in: "-32768"},
+	{in: "-32769"},
+	{in: "-2147483648"},
+	{in: "-2147483649"},
+	{in: "-9223372036854775808"},
+
+	{in: "1.5"},
+	{in: "-0.25"},
+	{in: "0.1"},
+	{in: "1e300", out: "1e+300"},
+	{in: "-5e-324"},
+
+	{in: `""`},
+	{in: `"naïve \"quoted\" \\ \n"`},
+	{in: quoted(strings.Repeat("x", 23))},
+	{in: quoted(strings.Repeat("x", 24))},
+	{in: quoted(strings.Repeat("x", 31))},
+	{in: quoted(strings.Repeat("x", 32))},
+	{in: quoted(strings.Repeat("x", 255))},
+	{in: quoted(strings.Repeat("x", 256))},
+	{in: quoted(strings.Repeat("x", 65535))},
+	{in: quoted(strings.Repeat("x", 65536))},
+
+	{in: "[]"},
+	{in: "{}"},
+	{in: `[1,"a",[null,{"b":[true]}]]`},
+	{in: `{"a":{"b":{"c":[1,2.5,"d"]}},"":null}`},
+	{in: manyItems(15)},
+	{in: manyItems(16)},
+	{in: manyItems(65536)},
+	{in: manyKeys(15)},
+	{in: manyKeys(16)},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range binaryCodecs {
+		for _, rt := range roundTrips {
+			want := rt.out
+			if want == "" {
+				want = rt.in
+			}
+
+			data := c.Marshal(nil, fastjson.MustParse(rt.in))
+			v, err := c.Unmarshal(nil, nil, data)
+			switch {
+			case err != nil:
+				t.Errorf("%s: unable to decode %.40s: %s", c.Name(), rt.in, err)
+			case v.String() != want:
+				t.Errorf("%s: %.40s became %.40s", c.Name(), rt.in, v.String())
+			}
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	for _, c := range binaryCodecs {
+		for _, rt := range roundTrips {
+			if len(rt.in) > 1000 {
+				continue
+			}
+			data := c.Marshal(nil, fastjson.MustParse(rt.in))
+			for i := 0; i < len(data); i++ {
+				if _, err := c.Unmarshal(nil, nil, data[:i]); err == nil {
+					t.Errorf("%s: %.40s truncated to %d bytes was decoded", c.Name(), rt.in, i)
+				}
+			}
+			if _, err := c.Unmarshal(nil, nil, append(data, 0)); err == nil {
+				t.Errorf("%s: %.40s with trailing data was decoded", c.Name(), rt.in)
+			}
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		c    Codec
+		data []byte
+		want string // "" for an error
+	}{
+		{CBOR, []byte{0x9f, 0x01, 0x02, 0xff}, "[1,2]"},
+		{CBOR, []byte{0xbf, 0x61, 'a', 0x01, 0xff}, `{"a":1}`},
+		{CBOR, []byte{0x7f, 0x61, 'a', 0x62, 'b', 'c', 0xff}, `"abc"`},
+		{CBOR, []byte{0xc1, 0x1a, 0x00, 0x00, 0x00, 0x01}, "1"}, // tags are ignored
+		{CBOR, []byte{0xf9, 0x3c, 0x00}, "1"},
+		{CBOR, []byte{0xfa, 0x3f, 0xc0, 0x00, 0x00}, "1.5"},
+		{CBOR, []byte{0xf7}, "null"},
+		{CBOR, []byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "-18446744073709551616"},
+		{MsgPack, []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, "1.5"},
+		{MsgPack, []byte{0xcc, 0x05}, "5"},
+		{MsgPack, []byte{0xd0, 0xfb}, "-5"},
+		{MsgPack, []byte{0xd9, 0x01, 'a'}, `"a"`},
+
+		// NaN and infinities can't be represented in JSON
+		{CBOR, []byte{0xf9, 0x7e, 0x00}, ""},
+		{CBOR, []byte{0xf9, 0x7c, 0x00}, ""},
+		{CBOR, []byte{0xf9, 0xfc, 0x00}, ""},
+		{CBOR, []byte{0xfa, 0x7f, 0x80, 0x00, 0x00}, ""},
+		{CBOR, []byte{0xfb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 0}, ""},
+		{MsgPack, []byte{0xca, 0x7f, 0xc0, 0x00, 0x00}, ""},
+		{MsgPack, []byte{0xcb, 0x7f, 0xf0, 0, 0, 0, 0, 0, 0}, ""},
+		{MsgPack, []byte{0xcb, 0xff, 0xf0, 0, 0, 0, 0, 0, 0}, ""},
+
+		// malformed or unsupported
+		{CBOR, nil, ""},
+		{CBOR, []byte{0x41, 'a'}, ""},        // byte string
+		{CBOR, []byte{0x1c}, ""},             // reserved additional information
+		{CBOR, []byte{0x1f}, ""},             // indefinite integer
+		{CBOR, []byte{0xa1, 0x01, 0x01}, ""}, // integer key
+		{CBOR, []byte{0xf0}, ""},             // unassigned simple value
+		{CBOR, []byte{0x9f, 0x01}, ""},       // unterminated indefinite array
+		{CBOR, []byte{0x7f, 0x01, 0xff}, ""}, // integer chunk in a text string
+		{CBOR, []byte{0x7b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, ""},
+		{MsgPack, nil, ""},
+		{MsgPack, []byte{0xc1}, ""},             // never used
+		{MsgPack, []byte{0xc4, 0x01, 'a'}, ""},  // bin
+		{MsgPack, []byte{0xd4, 0x01, 0x01}, ""}, // fixext
+		{MsgPack, []byte{0x81, 0x01, 0x01}, ""}, // integer key
+		{MsgPack, []byte{0xdb, 0xff, 0xff, 0xff, 0xff}, ""},
+		{MsgPack, []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, ""},
+	}
+
+	for _, tc := range cases {
+		v, err := tc.c.Unmarshal(nil, nil, tc.data)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("%s: % x was decoded to %s", tc.c.Name(), tc.data, v)
+		case tc.want != "" && err != nil:
+			t.Errorf("%s: unable to decode % x: %s", tc.c.Name(), tc.data, err)
+		case tc.want != "" && v.String() != tc.want:
+			t.Errorf("%s: % x was decoded to %s instead of %s", tc.c.Name(), tc.data, v, tc.want)
+		}
+	}
+}
+
+func TestDepthLimit(t *testing.T) {
+	nest := map[Codec]byte{CBOR: 0x81, MsgPack: 0x91} // arrays of one item
+	for c, array := range nest {
+		ok := append(bytes.Repeat([]byte{array}, maxDepth-1), 0x01)
+		if _, err := c.Unmarshal(nil, nil, ok); err != nil {
+			t.Errorf("%s: unable to decode %d nested arrays: %s", c.Name(), maxDepth-1, err)
+		}
+
+		deep := append(bytes.Repeat([]byte{array}, maxDepth), 0x01)
+		if _, err := c.Unmarshal(nil, nil, deep); err == nil {
+			t.Errorf("%s: %d nested arrays were decoded", c.Name(), maxDepth)
+		}
+	}
+}
+
+func TestByName(t *testing.T) {
+	for _, name := range []string{"", "json", "cbor", "msgpack"} {
+		c, err := ByName(name)
+		if err != nil || (name != "" && c.Name() != name) {
+			t.Errorf("ByName(%q) returned %v and %v", name, c, err)
+		}
+	}
+	if _, err := ByName("xml"); err == nil {
+		t.Errorf("ByName accepted an unknown encoding")
+	}
+}
@@ -0,0 +1,227 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/valyala/fastjson"
+)
+
+// msgpackCodec implements the JSON-compatible subset of MessagePack.
+// Binary and extension types aren't supported.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(dst []byte, v *fastjson.Value) []byte {
+	switch v.Type() {
+	case fastjson.TypeNull:
+		return append(dst, 0xc0)
+	case fastjson.TypeFalse:
+		return append(dst, 0xc2)
+	case fastjson.TypeTrue:
+		return append(dst, 0xc3)
+	case fastjson.TypeNumber:
+		if n, ok := integer(v); ok {
+			return msgpackInt(dst, n)
+		}
+		if n, err := v.Uint64(); err == nil {
+			return appendUint(append(dst, 0xcf), n, 8)
+		}
+		dst = append(dst, 0xcb)
+		return appendUint(dst, math.Float64bits(v.GetFloat64()), 8)
+	case fastjson.TypeString:
+		s := v.GetStringBytes()
+		dst = msgpackHead(dst, 0xa0, 32, 0xd9, uint64(len(s)))
+		return append(dst, s...)
+	case fastjson.TypeArray:
+		items := v.GetArray()
+		dst = msgpackHead(dst, 0x90, 16, 0xdc, uint64(len(items)))
+		for _, item := range items {
+			dst = MsgPack.Marshal(dst, item)
+		}
+		return dst
+	case fastjson.TypeObject:
+		o := v.GetObject()
+		dst = msgpackHead(dst, 0x80, 16, 0xde, uint64(o.Len()))
+		o.Visit(func(k []byte, item *fastjson.Value) {
+			dst = msgpackHead(dst, 0xa0, 32, 0xd9, uint64(len(k)))
+			dst = append(dst, k...)
+			dst = MsgPack.Marshal(dst, item)
+		})
+		return dst
+	default:
+		panic(fmt.Errorf("unknown fastjson type: %s", v.Type()))
+	}
+}
+
+func msgpackInt(dst []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(dst, byte(n))
+	case n < 0 && n >= -32:
+		return append(dst, byte(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return appendUint(append(dst, 0xd0), uint64(n), 1)
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return appendUint(append(dst, 0xd1), uint64(n), 2)
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return appendUint(append(dst, 0xd2), uint64(n), 4)
+	default:
+		return appendUint(append(dst, 0xd3), uint64(n), 8)
+	}
+}
+
+// msgpackHead writes the header of a string, array or map: fix is the
+// prefix of the short form, which holds lengths under fixLimit, and
+// first is the 8-bit (for strings) or 16-bit form, followed by the wider
+// ones. Arrays and maps have no 8-bit form.
+func msgpackHead(dst []byte, fix byte, fixLimit uint64, first byte, n uint64) []byte {
+	if n < fixLimit {
+		return append(dst, fix|byte(n))
+	}
+	if first == 0xd9 {
+		if n <= math.MaxUint8 {
+			return appendUint(append(dst, 0xd9), n, 1)
+		}
+		first = 0xda
+	}
+	if n <= math.MaxUint16 {
+		return appendUint(append(dst, first), n, 2)
+	}
+	return appendUint(append(dst, first+1), n, 4)
+}
+
+func (msgpackCodec) Unmarshal(p *fastjson.Parser, a *fastjson.Arena, data []byte) (*fastjson.Value, error) {
+	d := newDecoder(a, data)
+	v, err := d.msgpack()
+	if err != nil {
+		return nil, fmt.Errorf("invalid msgpack: %s", err)
+	}
+	if err := d.done(); err != nil {
+		return nil, fmt.Errorf("invalid msgpack: %s", err)
+	}
+	return v, nil
+}
+
+func (d *decoder) msgpack() (*fastjson.Value, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	start := d.pos
+	b, err := d.need(1)
+	if err != nil {
+		return nil, err
+	}
+	t := b[0]
+
+	switch {
+	case t <= 0x7f:
+		return d.a.NewNumberInt(int(t)), nil
+	case t >= 0xe0:
+		return d.a.NewNumberInt(int(int8(t))), nil
+	case t >= 0xa0 && t <= 0xbf:
+		return d.msgpackString(uint64(t & 0x1f))
+	case t >= 0x90 && t <= 0x9f:
+		return d.msgpackArray(uint64(t & 0x0f))
+	case t >= 0x80 && t <= 0x8f:
+		return d.msgpackMap(uint64(t & 0x0f))
+	}
+
+	switch t {
+	case 0xc0:
+		return d.a.NewNull(), nil
+	case 0xc2:
+		return d.a.NewFalse(), nil
+	case 0xc3:
+		return d.a.NewTrue(), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (t - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return d.a.NewNumberString(strconv.FormatUint(n, 10)), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (t - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := uint(64 - 8*size) // sign extension
+		return d.a.NewNumberString(strconv.FormatInt(int64(n<<shift)>>shift, 10)), nil
+	case 0xca:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return cborFloat(d.a, float64(math.Float32frombits(uint32(n))))
+	case 0xcb:
+		n, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return cborFloat(d.a, math.Float64frombits(n))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (t - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackString(n)
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackArray(n)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackMap(n)
+	default:
+		return nil, fmt.Errorf("unsupported type 0x%02x at %d", t, start)
+	}
+}
+
+func (d *decoder) msgpackString(n uint64) (*fastjson.Value, error) {
+	s, err := d.need(n)
+	if err != nil {
+		return nil, err
+	}
+	return d.a.NewStringBytes(s), nil
+}
+
+func (d *decoder) msgpackArray(n uint64) (*fastjson.Value, error) {
+	arr := d.a.NewArray()
+	for i := 0; uint64(i) < n; i++ {
+		item, err := d.msgpack()
+		if err != nil {
+			return nil, err
+		}
+		arr.SetArrayItem(i, item)
+	}
+	return arr, nil
+}
+
+func (d *decoder) msgpackMap(n uint64) (*fastjson.Value, error) {
+	o := d.a.NewObject()
+	for i := uint64(0); i < n; i++ {
+		key, err := d.msgpack()
+		if err != nil {
+			return nil, err
+		}
+		if key.Type() != fastjson.TypeString {
+			return nil, fmt.Errorf("map key is not a string (at %d)", d.pos)
+		}
+		item, err := d.msgpack()
+		if err != nil {
+			return nil, err
+		}
+		o.Set(string(key.GetStringBytes()), item)
+	}
+	return o, nil
+}
@@ -0,0 +1,179 @@
+package potoo
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+)
+
+// ErrCompetingService is returned by Loop when another service publishes
+// on our contract topic and the policy is CompetitionTerminate.
+var ErrCompetingService = errors.New("another service has published on our contract topic")
+
+// CompetitionPolicy tells what the connection does when it detects another
+// service which publishes on the same contract topic. In all cases a
+// CompetingService error is reported. The policy only applies to the
+// younger of two competing instances: the older one publishes its
+// contract again, so that the younger one notices it.
+type CompetitionPolicy int
+
+const (
+	// CompetitionLog only reports the competing service
+	CompetitionLog CompetitionPolicy = iota
+
+	// CompetitionTerminate makes Loop return ErrCompetingService. The
+	// connection disconnects without clearing the competitor's contract.
+	// A newly started instance terminates, and the one which was already
+	// running keeps serving. Competitors which publish no session are
+	// taken to be older.
+	CompetitionTerminate
+
+	// CompetitionBackOff stops serving calls and publishing values for
+	// ConnectionOptions.CompetitionDelay, after which the connection
+	// publishes its contract again. It takes over sooner if the
+	// competitor goes away.
+	CompetitionBackOff
+)
+
+// contracts which arrive on our contract topic are compared byte by byte
+// with the ones we've published and haven't seen arrive yet. Since a
+// competitor may publish the same contract as us, the session nonce is
+// also published (retained) on the session topic, before the contract.
+//
+// A session which arrives before our own belongs to an older instance (or
+// to an earlier run, if it's stale). When the older instance sees our
+// session after its own, it publishes its session again, and once we see
+// that after our own we know that we are the younger one and give way.
+const contractHistorySize = 8
+
+func (c *Connection) publishContract() {
+	if c.backingOff {
+		return
+	}
+
+	contract := c.contract
+	if m, ok := contract.(contracts.Map); ok && !c.opts.ContractVersion.IsZero() {
+		contract = contracts.WithVersion(m, c.opts.ContractVersion)
+	}
+
+	if !c.watchingContract {
+		c.watchingContract = true
+		c.clientSubscribe(c.contractTopic)
+		c.clientSubscribe(c.sessionTopic)
+	}
+
+	c.publish(mqtt.Message{
+		Topic:   c.sessionTopic,
+		Payload: []byte(c.session),
+		Retain:  true,
+	})
+	msg := c.publishContractMessage(contract)
+	c.publishedContracts = append(c.publishedContracts, append([]byte(nil), msg.Payload...))
+	if len(c.publishedContracts) > contractHistorySize {
+		c.publishedContracts = c.publishedContracts[1:]
+	}
+	c.publish(msg)
+}
+
+func (c *Connection) handleOwnContract(payload []byte) {
+	if c.contract == nil {
+		return
+	}
+
+	if len(payload) == 0 || string(payload) == "null" {
+		// our contract has been cleared (e.g. by the will of a competitor,
+		// or by our own will after reconnecting), so take it back
+		if c.backingOff {
+			c.stopBackingOff()
+		} else {
+			c.publishContract()
+		}
+		return
+	}
+
+	for i := range c.publishedContracts {
+		if string(payload) == string(c.publishedContracts[i]) {
+			// the older ones won't arrive anymore, but this one
+			// may be delivered again after reconnecting
+			c.publishedContracts = c.publishedContracts[i:]
+			c.newerCompetitor = false
+			return
+		}
+	}
+
+	if c.newerCompetitor {
+		// the contract of a newer instance, which arrived before the one
+		// we've published in reply to its session
+		return
+	}
+	c.competitorDetected(c.contractTopic)
+}
+
+// handleSessionAnnouncement checks the session on our session topic.
+// Sessions which arrive before our own may be stale (e.g. retained by an
+// earlier run), so they are only remembered. If one of them arrives again
+// after our own, its instance is alive and older than us.
+func (c *Connection) handleSessionAnnouncement(payload []byte) {
+	if c.contract == nil || len(payload) == 0 {
+		return
+	}
+	if string(payload) == c.session {
+		c.sessionSeen = true
+		return
+	}
+	if !c.sessionSeen {
+		if len(c.priorSessions) < contractHistorySize {
+			c.priorSessions[string(payload)] = struct{}{}
+		}
+		return
+	}
+
+	if _, ok := c.priorSessions[string(payload)]; ok {
+		c.competitorDetected(c.sessionTopic)
+		return
+	}
+
+	// a newer instance, which has to learn that we're here
+	c.err(newError(CompetingService, c.sessionTopic, "%s", ErrCompetingService))
+	c.newerCompetitor = true
+	c.publishContract()
+}
+
+func (c *Connection) competitorDetected(topic mqtt.Topic) {
+	c.err(newError(CompetingService, topic, "%s", ErrCompetingService))
+
+	switch c.opts.CompetitionPolicy {
+	case CompetitionTerminate:
+		c.fatalErr = ErrCompetingService
+	case CompetitionBackOff:
+		if !c.backingOff {
+			c.startBackingOff()
+		}
+	}
+}
+
+func (c *Connection) startBackingOff() {
+	for _, topic := range c.callTopics() {
+		c.unsubscribe(topic)
+	}
+
+	delay := c.opts.CompetitionDelay
+	if delay == 0 {
+		delay = 10 * time.Second
+	}
+
+	c.backingOff = true
+	c.retakeTimer = time.After(delay)
+}
+
+func (c *Connection) stopBackingOff() {
+	c.backingOff = false
+	c.retakeTimer = nil
+
+	err := c.restoreService()
+	if err != nil {
+		c.err(&Error{Category: TypeMismatch, Topic: c.contractTopic, Err: err})
+	}
+}
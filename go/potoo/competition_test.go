@@ -0,0 +1,161 @@
+package potoo
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+)
+
+func expectNoError(t *testing.T, errs <-chan *Error) {
+	t.Helper()
+
+	select {
+	case err := <-errs:
+		t.Errorf("unexpected error: %s", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCompetingServiceSameContract(t *testing.T) {
+	b := newFakeBroker()
+	contract := contracts.Map{"name": q.StringConst("lamp")}
+
+	errs := make(chan *Error, 16)
+	first := startService(t, b, ConnectionOptions{Errors: errs, InstanceID: "first"}, contract)
+	eventually(t, "the first service announces its session", func() bool {
+		session, _ := b.retainedValue("_session/things/svc")
+		return string(session) == first.session
+	})
+
+	startService(t, b, ConnectionOptions{InstanceID: "second"}, contract)
+	expectError(t, errs, CompetingService, "_session/things/svc")
+}
+
+func TestCompetingServiceTerminate(t *testing.T) {
+	b := newFakeBroker()
+	svc := startService(t, b, ConnectionOptions{CompetitionPolicy: CompetitionTerminate},
+		contracts.Map{"name": q.StringConst("lamp")})
+	eventually(t, "the service publishes its contract", func() bool {
+		_, ok := b.retainedValue("_contract/things/svc")
+		return ok
+	})
+
+	peer, _ := b.peer()
+	peer.publishContract(contracts.Map{"name": q.StringConst("impostor")})
+	select {
+	case <-svc.thatsAllFolks:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("service didn't terminate")
+	}
+	contract, _ := b.retainedValue("_contract/things/svc")
+	if !strings.Contains(string(contract), "impostor") {
+		t.Errorf("the competitor's contract was replaced with %s", contract)
+	}
+}
+
+func TestCompetingServiceTerminateNewest(t *testing.T) {
+	b := newFakeBroker()
+	errs := make(chan *Error, 16)
+	older := startService(t, b, ConnectionOptions{CompetitionPolicy: CompetitionTerminate, InstanceID: "older", Errors: errs},
+		contracts.Map{"name": q.StringConst("lamp")})
+	eventually(t, "the older service announces its session", func() bool {
+		session, _ := b.retainedValue("_session/things/svc")
+		return string(session) == older.session
+	})
+
+	newer := startService(t, b, ConnectionOptions{CompetitionPolicy: CompetitionTerminate, InstanceID: "newer"},
+		contracts.Map{"name": q.StringConst("impostor")})
+	select {
+	case <-newer.thatsAllFolks:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the newer service didn't terminate")
+	}
+	expectError(t, errs, CompetingService, "_session/things/svc")
+
+	select {
+	case <-older.thatsAllFolks:
+		t.Fatalf("the older service terminated")
+	case <-time.After(100 * time.Millisecond):
+	}
+	eventually(t, "the older service's contract is retained", func() bool {
+		contract, _ := b.retainedValue("_contract/things/svc")
+		session, _ := b.retainedValue("_session/things/svc")
+		return strings.Contains(string(contract), "lamp") && string(session) == older.session
+	})
+}
+
+func TestStaleSession(t *testing.T) {
+	b := newFakeBroker()
+	peer, _ := b.peer()
+	peer.Publish(mqtt.Message{Topic: mqtt.Topic("_session/things/svc"), Payload: []byte("earlier"), Retain: true})
+
+	errs := make(chan *Error, 16)
+	svc := startService(t, b, ConnectionOptions{Errors: errs}, contracts.Map{"name": q.StringConst("lamp")})
+	eventually(t, "the service announces its session", func() bool {
+		session, _ := b.retainedValue("_session/things/svc")
+		return string(session) == svc.session
+	})
+	expectNoError(t, errs)
+
+	contract, _ := b.retainedValue("_contract/things/svc")
+	if strings.Contains(string(contract), svc.session) {
+		t.Errorf("the session is part of the contract %s", contract)
+	}
+}
+
+func TestCompetingServiceBackOff(t *testing.T) {
+	b := newFakeBroker()
+	delay := 300 * time.Millisecond
+	startService(t, b, ConnectionOptions{CompetitionPolicy: CompetitionBackOff, CompetitionDelay: delay},
+		contracts.Map{"ping": fast})
+	eventually(t, "the service subscribes to calls", func() bool {
+		return b.subscribed("_call/things/svc/ping") && b.subscribed("_batch/things/svc")
+	})
+
+	peer, _ := b.peer()
+	peer.publishContract(contracts.Map{"name": q.StringConst("impostor")})
+	backedOff := time.Now()
+	eventually(t, "the service stops serving calls", func() bool {
+		return !b.subscribed("_call/things/svc/ping") && !b.subscribed("_batch/things/svc")
+	})
+
+	time.Sleep(delay / 2)
+	contract, _ := b.retainedValue("_contract/things/svc")
+	if !strings.Contains(string(contract), "impostor") || b.subscribed("_call/things/svc/ping") {
+		t.Errorf("the service took over before the delay, with contract %s", contract)
+	}
+
+	eventually(t, "the service takes over again", func() bool {
+		contract, _ := b.retainedValue("_contract/things/svc")
+		return strings.Contains(string(contract), "ping") && b.subscribed("_call/things/svc/ping")
+	})
+	if elapsed := time.Since(backedOff); elapsed < delay {
+		t.Errorf("the service took over after %s", elapsed)
+	}
+}
+
+func TestCompetingServiceBackOffCompetitorGone(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{CompetitionPolicy: CompetitionBackOff, CompetitionDelay: time.Minute},
+		contracts.Map{"ping": fast})
+	eventually(t, "the service subscribes to calls", func() bool {
+		return b.subscribed("_call/things/svc/ping")
+	})
+
+	peer, _ := b.peer()
+	peer.publishContract(contracts.Map{"name": q.StringConst("impostor")})
+	eventually(t, "the service stops serving calls", func() bool {
+		return !b.subscribed("_call/things/svc/ping")
+	})
+
+	// the competitor's will clears the contract
+	peer.Publish(mqtt.Message{Topic: mqtt.Topic("_contract/things/svc"), Payload: []byte("null"), Retain: true})
+	eventually(t, "the service takes over", func() bool {
+		contract, _ := b.retainedValue("_contract/things/svc")
+		return strings.Contains(string(contract), "ping") && b.subscribed("_call/things/svc/ping")
+	})
+}
@@ -0,0 +1,212 @@
+package contracts
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dexterlb/potoo/go/potoo/codec"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/types"
+)
+
+// ChangeKind tells what kind of difference between two versions of a
+// contract a Change describes
+type ChangeKind int
+
+const (
+	// PathAdded means that a value, callable or constant was added
+	PathAdded ChangeKind = iota
+
+	// PathRemoved means that a value, callable or constant was removed
+	PathRemoved
+
+	// NodeChanged means that a path holds a different kind of contract
+	// (e.g. a value became a callable)
+	NodeChanged
+
+	// TypeWidened means that a type accepts more values than before
+	TypeWidened
+
+	// TypeNarrowed means that a type accepts fewer values than before
+	TypeNarrowed
+
+	// TypeChanged means that a type is neither wider nor narrower
+	TypeChanged
+
+	// ConstantChanged means that the value of a constant changed
+	ConstantChanged
+
+	// StreamChanged means that a callable started or stopped streaming
+	StreamChanged
+
+	// EncodingChanged means that the payload encoding changed
+	EncodingChanged
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case PathAdded:
+		return "added"
+	case PathRemoved:
+		return "removed"
+	case NodeChanged:
+		return "kind changed"
+	case TypeWidened:
+		return "type widened"
+	case TypeNarrowed:
+		return "type narrowed"
+	case TypeChanged:
+		return "type changed"
+	case ConstantChanged:
+		return "constant changed"
+	case StreamChanged:
+		return "streaming changed"
+	case EncodingChanged:
+		return "encoding changed"
+	default:
+		return fmt.Sprintf("change_%d", int(k))
+	}
+}
+
+// Change is a difference between two versions of a contract
+type Change struct {
+	Path     mqtt.Topic
+	Kind     ChangeKind
+	Of       string // "argument", "result" or "value" for type changes
+	Breaking bool
+}
+
+func (c Change) String() string {
+	s := string(c.Path) + ": "
+	if c.Of != "" {
+		s += c.Of + " "
+	}
+	s += c.Kind.String()
+	if c.Breaking {
+		s += " (breaking)"
+	}
+	return s
+}
+
+// Compatible compares two versions of a contract, and tells if clients
+// of the old one can use the new one. Added paths and wider argument
+// types or narrower result and value types are backward compatible, and
+// any other change is breaking. Paths which start with "_" (such as the
+// version and the session) are ignored.
+func Compatible(old Contract, new Contract) (bool, []Change) {
+	oldNodes := leafNodes(old)
+	newNodes := leafNodes(new)
+
+	var changes []Change
+	for path, o := range oldNodes {
+		n, ok := newNodes[path]
+		if !ok {
+			changes = append(changes, Change{Path: mqtt.Topic(path), Kind: PathRemoved, Breaking: true})
+			continue
+		}
+		changes = append(changes, compareNodes(mqtt.Topic(path), o, n)...)
+	}
+	for path := range newNodes {
+		if _, ok := oldNodes[path]; !ok {
+			changes = append(changes, Change{Path: mqtt.Topic(path), Kind: PathAdded})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return string(changes[i].Path) < string(changes[j].Path)
+	})
+	compatible := true
+	for _, ch := range changes {
+		if ch.Breaking {
+			compatible = false
+		}
+	}
+	return compatible, changes
+}
+
+func leafNodes(c Contract) map[string]Contract {
+	nodes := make(map[string]Contract)
+	Traverse(c, func(subcontr Contract, topic mqtt.Topic) {
+		if _, ok := subcontr.(Map); ok {
+			return
+		}
+		if strings.HasPrefix(string(topic), "_") {
+			return
+		}
+		nodes[string(topic)] = subcontr
+	})
+	return nodes
+}
+
+func compareNodes(path mqtt.Topic, old Contract, new Contract) []Change {
+	var changes []Change
+	change := func(kind ChangeKind, of string, breaking bool) {
+		changes = append(changes, Change{Path: path, Kind: kind, Of: of, Breaking: breaking})
+	}
+
+	switch o := old.(type) {
+	case Value:
+		n, ok := new.(Value)
+		if !ok {
+			change(NodeChanged, "", true)
+			break
+		}
+		compareOutput(o.Type, n.Type, "value", change)
+		if codec.Or(o.Encoding).Name() != codec.Or(n.Encoding).Name() {
+			change(EncodingChanged, "value", true)
+		}
+	case Callable:
+		n, ok := new.(Callable)
+		if !ok {
+			change(NodeChanged, "", true)
+			break
+		}
+		switch {
+		case types.Equivalent(o.Argument, n.Argument):
+		case types.IsSubtype(o.Argument, n.Argument):
+			change(TypeWidened, "argument", false)
+		case types.IsSubtype(n.Argument, o.Argument):
+			change(TypeNarrowed, "argument", true)
+		default:
+			change(TypeChanged, "argument", true)
+		}
+		_, oldVoid := o.Retval.T.(*types.TVoid)
+		_, newVoid := n.Retval.T.(*types.TVoid)
+		if oldVoid != newVoid {
+			// clients expect a reply iff the result isn't void
+			change(TypeChanged, "result", true)
+		} else {
+			compareOutput(o.Retval, n.Retval, "result", change)
+		}
+		if o.IsStream() != n.IsStream() {
+			change(StreamChanged, "", true)
+		}
+		if codec.Or(o.Encoding).Name() != codec.Or(n.Encoding).Name() {
+			change(EncodingChanged, "", true)
+		}
+	case Constant:
+		n, ok := new.(Constant)
+		if !ok {
+			change(NodeChanged, "", true)
+			break
+		}
+		if n.Value.String() != o.Value.String() {
+			change(ConstantChanged, "", true)
+		}
+	}
+	return changes
+}
+
+// compareOutput compares types of values which clients receive
+func compareOutput(old types.Type, new types.Type, of string, change func(ChangeKind, string, bool)) {
+	switch {
+	case types.Equivalent(old, new):
+	case types.IsSubtype(new, old):
+		change(TypeNarrowed, of, false)
+	case types.IsSubtype(old, new):
+		change(TypeWidened, of, true)
+	default:
+		change(TypeChanged, of, true)
+	}
+}
@@ -0,0 +1,145 @@
+package contracts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dexterlb/potoo/go/potoo/codec"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+func call(argument types.Type, retval types.Type) Callable {
+	return Callable{Argument: argument, Retval: retval}
+}
+
+func constant(s string) Constant {
+	return Constant{Value: fastjson.MustParse(s)}
+}
+
+func TestCompatible(t *testing.T) {
+	cases := []struct {
+		name    string
+		old     Contract
+		new     Contract
+		want    bool
+		changes string
+	}{
+		{
+			name: "same",
+			old:  Map{"a": call(types.Int(), types.Int()), "b": Value{Type: types.Int()}},
+			new:  Map{"a": call(types.Int(), types.Int()), "b": Value{Type: types.Int()}},
+			want: true,
+		},
+		{
+			name:    "added",
+			old:     Map{"a": constant(`1`)},
+			new:     Map{"a": constant(`1`), "b": Map{"c": constant(`2`)}},
+			want:    true,
+			changes: "b/c: added",
+		},
+		{
+			name:    "removed",
+			old:     Map{"a": constant(`1`), "b": Map{"c": constant(`2`)}},
+			new:     Map{"a": constant(`1`)},
+			changes: "b/c: removed (breaking)",
+		},
+		{
+			name:    "kind changed",
+			old:     Map{"a": Value{Type: types.Int()}},
+			new:     Map{"a": call(types.Null(), types.Int())},
+			changes: "a: kind changed (breaking)",
+		},
+		{
+			name:    "argument widened",
+			old:     Map{"a": call(types.Int(), types.Null())},
+			new:     Map{"a": call(types.Float(), types.Null())},
+			want:    true,
+			changes: "a: argument type widened",
+		},
+		{
+			name:    "argument narrowed",
+			old:     Map{"a": call(types.Float(), types.Null())},
+			new:     Map{"a": call(types.Int(), types.Null())},
+			changes: "a: argument type narrowed (breaking)",
+		},
+		{
+			name:    "argument changed",
+			old:     Map{"a": call(types.Int(), types.Null())},
+			new:     Map{"a": call(types.String(), types.Null())},
+			changes: "a: argument type changed (breaking)",
+		},
+		{
+			name:    "result narrowed",
+			old:     Map{"a": call(types.Null(), types.Union(types.Int(), types.Null()))},
+			new:     Map{"a": call(types.Null(), types.Int())},
+			want:    true,
+			changes: "a: result type narrowed",
+		},
+		{
+			name:    "result widened",
+			old:     Map{"a": call(types.Null(), types.Int())},
+			new:     Map{"a": call(types.Null(), types.Float())},
+			changes: "a: result type widened (breaking)",
+		},
+		{
+			name:    "result no longer void",
+			old:     Map{"a": call(types.Null(), types.Void())},
+			new:     Map{"a": call(types.Null(), types.Null())},
+			changes: "a: result type changed (breaking)",
+		},
+		{
+			name:    "streaming",
+			old:     Map{"a": call(types.Null(), types.Int())},
+			new:     Map{"a": Callable{Argument: types.Null(), Retval: types.Int(), Stream: true}},
+			changes: "a: streaming changed (breaking)",
+		},
+		{
+			name:    "callable encoding",
+			old:     Map{"a": call(types.Null(), types.Int())},
+			new:     Map{"a": Callable{Argument: types.Null(), Retval: types.Int(), Encoding: codec.CBOR}},
+			changes: "a: encoding changed (breaking)",
+		},
+		{
+			name: "explicit json encoding",
+			old:  Map{"a": Value{Type: types.Int()}},
+			new:  Map{"a": Value{Type: types.Int(), Encoding: codec.JSON}},
+			want: true,
+		},
+		{
+			name:    "value narrowed and encoding changed",
+			old:     Map{"a": Value{Type: types.Float()}},
+			new:     Map{"a": Value{Type: types.Int(), Encoding: codec.MsgPack}},
+			changes: "a: value type narrowed, a: value encoding changed (breaking)",
+		},
+		{
+			name:    "constant changed",
+			old:     Map{"a": constant(`{"x": 1}`)},
+			new:     Map{"a": constant(`{"x": 2}`)},
+			changes: "a: constant changed (breaking)",
+		},
+		{
+			name: "ignored paths",
+			old:  Map{VersionKey: constant(`"1.0.0"`), "_session": constant(`"a"`)},
+			new:  Map{VersionKey: constant(`"2.0.0"`)},
+			want: true,
+		},
+		{
+			name:    "sorted by path",
+			old:     Map{"b": constant(`1`), "c": constant(`1`)},
+			new:     Map{"a": constant(`1`), "c": constant(`2`)},
+			changes: "a: added, b: removed (breaking), c: constant changed (breaking)",
+		},
+	}
+
+	for _, c := range cases {
+		ok, changes := Compatible(c.old, c.new)
+		descriptions := make([]string, len(changes))
+		for i := range changes {
+			descriptions[i] = changes[i].String()
+		}
+		if got := strings.Join(descriptions, ", "); ok != c.want || got != c.changes {
+			t.Errorf("%s: got %v with changes '%s'", c.name, ok, got)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package contracts
 
 import (
+	"time"
+
 	"github.com/dexterlb/potoo/go/potoo/bus"
+	"github.com/dexterlb/potoo/go/potoo/codec"
 	"github.com/dexterlb/potoo/go/potoo/types"
 	"github.com/valyala/fastjson"
 )
@@ -26,6 +29,7 @@ type Value struct {
 	Type        types.Type
 	Subcontract Contract
 	Bus         bus.Bus
+	Encoding    codec.Codec // of the published values (JSON if nil)
 }
 
 func (v Value) contractNode() string { return "value" }
@@ -35,7 +39,41 @@ type Callable struct {
 	Retval      types.Type
 	Subcontract Contract
 	Handler     bus.RetHandler
+	ErrHandler  bus.ErrRetHandler // used instead of Handler if set
+	CtxHandler  bus.CtxRetHandler // used instead of the above if set
+	Timeout     time.Duration     // the deadline of the handler context
 	Async       bool
+
+	// StreamHandler makes the callable reply with a sequence of values of
+	// type Retval instead of a single one. Streaming callables are always
+	// async. Stream is set on decoded streaming callables.
+	StreamHandler bus.StreamHandler
+	Stream        bool
+
+	// MaxConcurrent limits the number of calls to an async callable which
+	// are handled at the same time (0 means no limit besides the one of
+	// the connection). Serialized is the same as MaxConcurrent = 1, for
+	// handlers which are not thread-safe.
+	MaxConcurrent int
+	Serialized    bool
+
+	// Roles, if not empty, makes the callable refuse calls from callers
+	// which don't have any of them
+	Roles []string
+
+	// RateLimit limits the calls to the callable, and CallerRateLimit
+	// limits the calls to it from each caller
+	RateLimit       *RateLimit
+	CallerRateLimit *RateLimit
+
+	// Encoding is the encoding of arguments and results (JSON if nil).
+	// Calls in the JSON object format always carry JSON.
+	Encoding codec.Codec
 }
 
 func (c Callable) contractNode() string { return "callable" }
+
+// IsStream tells if the callable replies with a sequence of values
+func (c Callable) IsStream() bool {
+	return c.Stream || c.StreamHandler != nil
+}
@@ -3,6 +3,7 @@ package contracts
 import (
 	"fmt"
 
+	"github.com/dexterlb/potoo/go/potoo/codec"
 	"github.com/dexterlb/potoo/go/potoo/types"
 	"github.com/valyala/fastjson"
 )
@@ -33,7 +34,7 @@ func Decode(v *fastjson.Value) (Contract, error) {
 		}
 		return decodeMap(v)
 	default:
-		panic("no such type!")
+		return nil, fmt.Errorf("contract must be an object or null, not %s", v.Type())
 	}
 }
 
@@ -42,6 +43,10 @@ func decodeValue(v *fastjson.Value) (Contract, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid type on value: %s", err)
 	}
+	encoding, err := decodeEncoding(v.Get("type"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encoding on value: %s", err)
+	}
 	subcontract, err := Decode(v.Get("subcontract"))
 	if err != nil {
 		return nil, fmt.Errorf("invalid subcontract on value: %s", err)
@@ -50,6 +55,7 @@ func decodeValue(v *fastjson.Value) (Contract, error) {
 	return Value{
 		Type:        typ,
 		Subcontract: subcontract,
+		Encoding:    encoding,
 	}, nil
 }
 
@@ -79,6 +85,10 @@ func decodeCallable(v *fastjson.Value) (Contract, error) {
 	if err != nil {
 		return nil, fmt.Errorf("invalid retval on callable: %s", err)
 	}
+	encoding, err := decodeEncoding(v.Get("argument"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encoding on callable: %s", err)
+	}
 	subcontract, err := Decode(v.Get("subcontract"))
 	if err != nil {
 		return nil, fmt.Errorf("invalid subcontract on callable: %s", err)
@@ -88,9 +98,20 @@ func decodeCallable(v *fastjson.Value) (Contract, error) {
 		Argument:    argument,
 		Retval:      retval,
 		Subcontract: subcontract,
+		Stream:      v.GetBool("stream"),
+		Encoding:    encoding,
 	}, nil
 }
 
+// decodeEncoding returns the codec of a schema (nil for JSON)
+func decodeEncoding(schema *fastjson.Value) (codec.Codec, error) {
+	name := types.SchemaEncoding(schema)
+	if name == "json" {
+		return nil, nil
+	}
+	return codec.ByName(name)
+}
+
 func decodeMap(v *fastjson.Value) (Map, error) {
 	o, err := v.Object()
 	noerr(err)
@@ -142,7 +163,7 @@ func (c Constant) encode(a *fastjson.Arena) *fastjson.Value {
 func (v Value) encode(a *fastjson.Arena) *fastjson.Value {
 	o := a.NewObject()
 	o.Set("_t", a.NewString(v.contractNode()))
-	o.Set("type", types.EncodeSchema(a, v.Type))
+	o.Set("type", types.EncodeSchemaAs(a, v.Type, codec.Or(v.Encoding).Name()))
 	encodeSubcontract(a, o, v.Subcontract)
 	return o
 }
@@ -150,8 +171,12 @@ func (v Value) encode(a *fastjson.Arena) *fastjson.Value {
 func (c Callable) encode(a *fastjson.Arena) *fastjson.Value {
 	o := a.NewObject()
 	o.Set("_t", a.NewString(c.contractNode()))
-	o.Set("argument", types.EncodeSchema(a, c.Argument))
-	o.Set("retval", types.EncodeSchema(a, c.Retval))
+	encoding := codec.Or(c.Encoding).Name()
+	o.Set("argument", types.EncodeSchemaAs(a, c.Argument, encoding))
+	o.Set("retval", types.EncodeSchemaAs(a, c.Retval, encoding))
+	if c.IsStream() {
+		o.Set("stream", a.NewTrue())
+	}
 	encodeSubcontract(a, o, c.Subcontract)
 	return o
 }
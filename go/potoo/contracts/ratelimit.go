@@ -0,0 +1,8 @@
+package contracts
+
+// RateLimit is a token bucket: up to Burst calls may be made at once, and
+// the bucket refills at Rate calls per second
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
@@ -1,7 +1,10 @@
 package contracts
 
 import (
+	"fmt"
+
 	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/types"
 )
 
 func Traverse(c Contract, f func(Contract, mqtt.Topic)) {
@@ -28,3 +31,43 @@ func traverseHelper(c Contract, f func(Contract, mqtt.Topic), topic mqtt.Topic)
 		}
 	}
 }
+
+// Validate checks that all keys of maps in the contract can be used as
+// topic levels (see mqtt.CheckKey and mqtt.EscapeKey), and that the
+// constraint metadata of its types is valid (see types.ValidateConstraints)
+func Validate(c Contract) error {
+	var err error
+	Traverse(c, func(subcontr Contract, topic mqtt.Topic) {
+		if err != nil {
+			return
+		}
+		err = validateNode(subcontr)
+		if err != nil && len(topic) != 0 {
+			err = fmt.Errorf("under '%s': %s", string(topic), err)
+		}
+	})
+	return err
+}
+
+func validateNode(c Contract) error {
+	switch s := c.(type) {
+	case Map:
+		for key := range s {
+			if err := mqtt.CheckKey(key); err != nil {
+				return err
+			}
+		}
+	case Value:
+		if err := types.ValidateConstraints(s.Type); err != nil {
+			return fmt.Errorf("type %s: %s", s.Type, err)
+		}
+	case Callable:
+		if err := types.ValidateConstraints(s.Argument); err != nil {
+			return fmt.Errorf("argument type %s: %s", s.Argument, err)
+		}
+		if err := types.ValidateConstraints(s.Retval); err != nil {
+			return fmt.Errorf("return type %s: %s", s.Retval, err)
+		}
+	}
+	return nil
+}
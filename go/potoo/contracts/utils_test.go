@@ -0,0 +1,94 @@
+package contracts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		contract Contract
+		err      string // a part of the error, or "" if valid
+	}{
+		{name: "empty", contract: Map{}},
+		{name: "nil", contract: nil},
+		{
+			name: "escaped keys",
+			contract: Map{
+				mqtt.EscapeKey("a/b"):    constant(`1`),
+				mqtt.EscapeKey(""):       constant(`1`),
+				mqtt.EscapeKey("\xff#+"): constant(`1`),
+				"ünïcode":                constant(`1`),
+			},
+		},
+		{name: "empty key", contract: Map{"": constant(`1`)}, err: "key is empty"},
+		{name: "slash", contract: Map{"a/b": constant(`1`)}, err: "contains '/'"},
+		{name: "plus", contract: Map{"a+": constant(`1`)}, err: "contains '+'"},
+		{name: "hash", contract: Map{"#": constant(`1`)}, err: "contains '#'"},
+		{name: "nul", contract: Map{"a\x00": constant(`1`)}, err: "contains '\x00'"},
+		{name: "invalid utf-8", contract: Map{"\xff": constant(`1`)}, err: "not valid UTF-8"},
+		{
+			name:     "nested",
+			contract: Map{"a": Map{"b": Map{"c/d": constant(`1`)}}},
+			err:      "under 'a/b': key 'c/d'",
+		},
+		{
+			name: "subcontract",
+			contract: Map{"a": Callable{
+				Argument:    types.Null(),
+				Retval:      types.Null(),
+				Subcontract: Map{"#": constant(`1`)},
+			}},
+			err: "under 'a': key '#'",
+		},
+		{
+			name: "subcontract of a value",
+			contract: Map{"a": Value{
+				Type:        types.Int(),
+				Subcontract: Map{"b": Map{"": constant(`1`)}},
+			}},
+			err: "under 'a/b': key is empty",
+		},
+		{
+			name: "bad value constraint",
+			contract: Map{"a": Value{
+				Type: types.Int().M(types.MetaData{types.MetaMin: fastjson.MustParse(`"zero"`)}),
+			}},
+			err: "under 'a': type int",
+		},
+		{
+			name: "bad argument constraint",
+			contract: Map{"a": Map{"b": Callable{
+				Argument: types.List(types.String().M(types.MetaData{types.MetaPattern: fastjson.MustParse(`"("`)})),
+				Retval:   types.Null(),
+			}}},
+			err: "under 'a/b': argument type",
+		},
+		{
+			name: "bad return constraint",
+			contract: Callable{
+				Argument: types.Null(),
+				Retval: types.Int().M(types.MetaData{
+					types.MetaMin: fastjson.MustParse(`2`),
+					types.MetaMax: fastjson.MustParse(`1`),
+				}),
+			},
+			err: "return type",
+		},
+	}
+
+	for _, c := range cases {
+		err := Validate(c.contract)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %s", c.name, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: got %v instead of an error with '%s'", c.name, err, c.err)
+		}
+	}
+}
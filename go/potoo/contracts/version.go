@@ -0,0 +1,86 @@
+package contracts
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// VersionKey is the key of the constant which holds the contract version
+// at the root of Map contracts
+const VersionKey = "_version"
+
+// Version is a semantic version of a contract. The major version changes
+// with every breaking change (see Compatible).
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// IsZero tells if the version is unset
+func (v Version) IsZero() bool {
+	return v == Version{}
+}
+
+// ParseVersion parses a version of the form "major.minor.patch" (the
+// minor and patch versions may be omitted)
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("invalid version '%s'", s)
+	}
+	fields := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version '%s'", s)
+		}
+		*fields[i] = n
+	}
+	return v, nil
+}
+
+func MustParseVersion(s string) Version {
+	v, err := ParseVersion(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// VersionOf returns the version of a contract (the zero version if it
+// has none)
+func VersionOf(c Contract) (Version, error) {
+	m, ok := c.(Map)
+	if !ok {
+		return Version{}, nil
+	}
+	vc, ok := m[VersionKey].(Constant)
+	if !ok {
+		return Version{}, nil
+	}
+	s, err := vc.Value.StringBytes()
+	if err != nil {
+		return Version{}, fmt.Errorf("contract version is not a string")
+	}
+	return ParseVersion(string(s))
+}
+
+// WithVersion returns a copy of the Map contract with the version set
+func WithVersion(m Map, v Version) Map {
+	var a fastjson.Arena
+	versioned := make(Map, len(m)+1)
+	for k := range m {
+		versioned[k] = m[k]
+	}
+	versioned[VersionKey] = Constant{Value: a.NewString(v.String())}
+	return versioned
+}
@@ -0,0 +1,79 @@
+package potoo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/bus"
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+func TestCallInfo(t *testing.T) {
+	b := newFakeBroker()
+	infos := make(chan bus.CallInfo, 1)
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"lamp": contracts.Map{
+			"greet": contracts.Callable{
+				Argument: types.Null(),
+				Retval:   types.Void(),
+				CtxHandler: func(ctx context.Context, a *fastjson.Arena, arg *fastjson.Value) (*fastjson.Value, error) {
+					info, ok := bus.CallInfoFrom(ctx)
+					if !ok {
+						return nil, errors.New("no call info")
+					}
+					infos <- *info
+					return nil, nil
+				},
+			},
+		},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	_, err := cl.Call(context.Background(), mqtt.Topic("svc/lamp/greet"), q.Json(nil))
+	if err != nil {
+		t.Fatalf("call failed: %s", err)
+	}
+	info := <-infos
+	if string(info.Topic) != "_call/things/svc/lamp/greet" || string(info.Path) != "lamp/greet" {
+		t.Errorf("call info has topic '%s' and path '%s'", info.Topic, info.Path)
+	}
+	if !strings.HasPrefix(string(info.ReplyTopic), "_reply/") || info.Token == "" {
+		t.Errorf("call info has reply topic '%s' and token '%s'", info.ReplyTopic, info.Token)
+	}
+}
+
+func TestCallDeadline(t *testing.T) {
+	b := newFakeBroker()
+	errs := make(chan *Error, 16)
+	startService(t, b, ConnectionOptions{Errors: errs}, contracts.Map{
+		"sleep": contracts.Callable{
+			Argument: types.Null(),
+			Retval:   types.Null(),
+			Timeout:  50 * time.Millisecond,
+			Async:    true,
+			CtxHandler: func(ctx context.Context, a *fastjson.Arena, arg *fastjson.Value) (*fastjson.Value, error) {
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(5 * time.Second):
+					return nil, nil
+				}
+			},
+		},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	_, err := cl.Call(context.Background(), mqtt.Topic("svc/sleep"), q.Json(nil))
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != "deadline_exceeded" {
+		t.Errorf("call failed with %v instead of an exceeded deadline", err)
+	}
+	expectError(t, errs, DeadlineExceeded, "_call/things/svc/sleep")
+}
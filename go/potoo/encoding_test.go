@@ -0,0 +1,50 @@
+package potoo
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/dexterlb/potoo/go/potoo/codec"
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+func echo(enc codec.Codec) contracts.Callable {
+	return contracts.Callable{
+		Argument: types.String(),
+		Retval:   types.String(),
+		Encoding: enc,
+		Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+			return arg
+		},
+	}
+}
+
+func TestEncodedCalls(t *testing.T) {
+	for _, enc := range []codec.Codec{codec.CBOR, codec.MsgPack} {
+		for _, version := range []int{ProtocolV1, ProtocolV2} {
+			b := newFakeBroker()
+			startService(t, b, ConnectionOptions{}, contracts.Map{"echo": echo(enc)})
+			cl := startClient(t, b, ConnectionOptions{ProtocolVersion: version})
+			_, replies := b.peer("_reply/#")
+
+			// the CBOR encoding of "rror " is "error "
+			for _, s := range []string{"rror ", "hunk ", "end", ""} {
+				r, err := cl.Call(context.Background(), mqtt.Topic("svc/echo"), q.String(s))
+				if err != nil || string(r.GetStringBytes()) != s {
+					t.Errorf("%s call (version %d) with '%s' returned %v and %v", enc.Name(), version, s, r, err)
+				}
+
+				reply := receive(t, replies, "_reply/#")
+				binary := version < ProtocolV2
+				if bytes.Contains(reply.Payload, []byte(" result ")) != binary {
+					t.Errorf("%s reply (version %d) is '%q'", enc.Name(), version, reply.Payload)
+				}
+			}
+		}
+	}
+}
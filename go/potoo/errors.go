@@ -0,0 +1,218 @@
+package potoo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dexterlb/potoo/go/potoo/logging"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+// ErrorCategory tells what kind of problem an Error describes
+type ErrorCategory int
+
+const (
+	// UnknownTopic means that a message arrived on a topic which the
+	// connection doesn't handle
+	UnknownTopic ErrorCategory = iota
+
+	// BadArgument means that a call argument couldn't be parsed
+	BadArgument
+
+	// TypeMismatch means that an argument, a return value or a value
+	// doesn't match its type in the contract
+	TypeMismatch
+
+	// HandlerFailure means that a call handler panicked or misbehaved
+	HandlerFailure
+
+	// BadContract means that a remote contract couldn't be decoded
+	BadContract
+
+	// BadMessage means that a remote value or a reply couldn't be parsed
+	BadMessage
+
+	// CompetingService means that someone else has published a contract
+	// on our contract topic
+	CompetingService
+
+	// DeadlineExceeded means that a call handler didn't finish before
+	// the deadline of its callable
+	DeadlineExceeded
+
+	// Overloaded means that a call was rejected because too many calls
+	// are already pending
+	Overloaded
+
+	// ShuttingDown means that a call was rejected because the service is
+	// shutting down
+	ShuttingDown
+
+	// PermissionDenied means that the caller isn't allowed to perform
+	// the call
+	PermissionDenied
+
+	// ClientIDCollision means that another MQTT client uses our client ID
+	ClientIDCollision
+
+	// RateLimited means that a call was rejected because of the rate
+	// limit of its callable
+	RateLimited
+
+	// Aborted means that a call in an atomic batch wasn't performed
+	// because another call in the batch failed
+	Aborted
+
+	// IncompatibleVersion means that a remote contract was ignored
+	// because its version isn't accepted
+	IncompatibleVersion
+)
+
+func (e ErrorCategory) String() string {
+	switch e {
+	case UnknownTopic:
+		return "unknown_topic"
+	case BadArgument:
+		return "bad_argument"
+	case TypeMismatch:
+		return "type_mismatch"
+	case HandlerFailure:
+		return "handler_failure"
+	case BadContract:
+		return "bad_contract"
+	case BadMessage:
+		return "bad_message"
+	case CompetingService:
+		return "competing_service"
+	case DeadlineExceeded:
+		return "deadline_exceeded"
+	case Overloaded:
+		return "overloaded"
+	case ShuttingDown:
+		return "shutting_down"
+	case PermissionDenied:
+		return "permission_denied"
+	case ClientIDCollision:
+		return "client_id_collision"
+	case RateLimited:
+		return "rate_limited"
+	case Aborted:
+		return "aborted"
+	case IncompatibleVersion:
+		return "incompatible_version"
+	default:
+		return fmt.Sprintf("error_%d", int(e))
+	}
+}
+
+// Error is an error which happened while processing a message. Errors
+// are reported to ConnectionOptions.OnError and ConnectionOptions.Errors,
+// and the connection keeps serving afterwards.
+type Error struct {
+	Category ErrorCategory
+	Topic    mqtt.Topic
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s on '%s': %s", e.Category, string(e.Topic), e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(category ErrorCategory, topic mqtt.Topic, format string, args ...interface{}) *Error {
+	return &Error{
+		Category: category,
+		Topic:    append(mqtt.Topic(nil), topic...),
+		Err:      fmt.Errorf(format, args...),
+	}
+}
+
+// err reports the error to the error sinks. It must be called from the loop.
+func (c *Connection) err(err *Error) {
+	if c.opts.OnError == nil && c.opts.Errors == nil {
+		c.log.Warn(err.Category.String(), logging.KeyTopic, string(err.Topic), logging.KeyError, err.Err)
+		return
+	}
+	c.log.Debug(err.Category.String(), logging.KeyTopic, string(err.Topic), logging.KeyError, err.Err)
+
+	if c.opts.Errors != nil {
+		select {
+		case c.opts.Errors <- err:
+		default:
+			// the reader is too slow, drop the error
+		}
+	}
+
+	if c.opts.OnError != nil {
+		c.deliveries.push(func() {
+			c.opts.OnError(err)
+		})
+	}
+}
+
+// Code returns the machine-readable code which is sent to callers when
+// this error happens during a call. It is the category name, unless the
+// underlying error has a `Code() string` method.
+func (e *Error) Code() string {
+	var coder interface{ Code() string }
+	if errors.As(e.Err, &coder) {
+		return coder.Code()
+	}
+	return e.Category.String()
+}
+
+// Path returns the path to the mismatching part of the value for
+// TypeMismatch errors, and nil otherwise.
+func (e *Error) Path() []string {
+	var cerr *types.CheckError
+	if errors.As(e.Err, &cerr) {
+		return cerr.Path
+	}
+	return nil
+}
+
+// RemoteError is returned by Call when the service replies with an error
+type RemoteError struct {
+	Code    string
+	Message string
+	Path    []string
+}
+
+func (e *RemoteError) Error() string {
+	if len(e.Path) == 0 {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s at %s: %s", e.Code, strings.Join(e.Path, "/"), e.Message)
+}
+
+// encodeCallError makes the error object which is sent to the caller:
+// {"code": <code>, "message": <message>, "path": [<path element>, ...]}
+func encodeCallError(a *fastjson.Arena, err *Error) *fastjson.Value {
+	path := a.NewArray()
+	for i, elem := range err.Path() {
+		path.SetArrayItem(i, a.NewString(elem))
+	}
+
+	o := a.NewObject()
+	o.Set("code", a.NewString(err.Code()))
+	o.Set("message", a.NewString(err.Err.Error()))
+	o.Set("path", path)
+	return o
+}
+
+func decodeCallError(v *fastjson.Value) *RemoteError {
+	rerr := &RemoteError{
+		Code:    string(v.GetStringBytes("code")),
+		Message: string(v.GetStringBytes("message")),
+	}
+	for _, elem := range v.GetArray("path") {
+		rerr.Path = append(rerr.Path, string(elem.GetStringBytes()))
+	}
+	return rerr
+}
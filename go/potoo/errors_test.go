@@ -0,0 +1,80 @@
+package potoo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+func expectError(t *testing.T, errs <-chan *Error, category ErrorCategory, topic string) {
+	t.Helper()
+
+	select {
+	case err := <-errs:
+		if err.Category != category || string(err.Topic) != topic {
+			t.Errorf("got error %s instead of %s on '%s'", err, category, topic)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("timed out waiting for %s error", category)
+	}
+}
+
+func TestErrorSinks(t *testing.T) {
+	b := newFakeBroker()
+	errs := make(chan *Error, 16)
+	callbackErrs := make(chan *Error, 16)
+	startService(t, b, ConnectionOptions{
+		Errors: errs,
+		OnError: func(err *Error) {
+			callbackErrs <- err
+		},
+	}, contracts.Map{
+		"fail": contracts.Callable{
+			Argument: types.Null(),
+			Retval:   types.Void(),
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				panic("oops")
+			},
+		},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	cl.Call(context.Background(), mqtt.Topic("svc/fail"), q.Json(nil))
+	expectError(t, errs, HandlerFailure, "_call/things/svc/fail")
+	expectError(t, callbackErrs, HandlerFailure, "_call/things/svc/fail")
+
+	peer, _ := b.peer()
+	peer.Publish(mqtt.Message{Topic: mqtt.Topic("_call/things/svc/fail"), Payload: []byte("reply token {")})
+	expectError(t, errs, BadArgument, "_call/things/svc/fail")
+	expectError(t, callbackErrs, BadArgument, "_call/things/svc/fail")
+}
+
+func TestErrorSinkOverflow(t *testing.T) {
+	b := newFakeBroker()
+	errs := make(chan *Error) // noone reads from it
+	startService(t, b, ConnectionOptions{Errors: errs}, contracts.Map{
+		"add": contracts.Callable{
+			Argument: types.Int(),
+			Retval:   types.Int(),
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				return arg
+			},
+		},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	peer, _ := b.peer()
+	for i := 0; i < 3; i++ {
+		peer.Publish(mqtt.Message{Topic: mqtt.Topic("_call/things/svc/add"), Payload: []byte(`reply token "x"`)})
+	}
+	r, err := cl.Call(context.Background(), mqtt.Topic("svc/add"), q.Int(1))
+	if err != nil || r.GetInt() != 1 {
+		t.Errorf("service got stuck on reporting errors: (%v, %v)", r, err)
+	}
+}
@@ -0,0 +1,110 @@
+package potoo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+type codedError struct{}
+
+func (codedError) Error() string { return "the light is broken" }
+func (codedError) Code() string  { return "broken_light" }
+
+func TestErrorReplyFormat(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"set": contracts.Callable{
+			Argument: types.Struct(map[string]types.Type{"level": types.Int()}),
+			Retval:   types.Void(),
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				return nil
+			},
+		},
+	})
+	peer, replies := b.peer("_reply/#")
+
+	peer.Publish(mqtt.Message{Topic: mqtt.Topic("_call/things/svc/set"), Payload: []byte(`r t1 {"level": "high"}`)})
+	reply := receive(t, replies, "_reply/r")
+	token, data := parseReplyMessage(reply.Payload)
+	if string(token) != "t1" {
+		t.Errorf("error reply has token '%s' instead of 't1'", token)
+	}
+	_, err := parseReply(data, nil)
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("error reply '%s' is parsed as %v", reply.Payload, err)
+	}
+	if rerr.Code != "type_mismatch" || len(rerr.Path) != 1 || rerr.Path[0] != "level" {
+		t.Errorf("error reply '%s' has code %s and path %v", reply.Payload, rerr.Code, rerr.Path)
+	}
+
+	peer.Publish(mqtt.Message{Topic: mqtt.Topic("_call/things/svc/set"), Payload: []byte(`{"version":2,"topic":"r","token":"t2","argument":1}`)})
+	reply = receive(t, replies, "_reply/r")
+	v, err := fastjson.ParseBytes(reply.Payload)
+	if err != nil || string(v.GetStringBytes("token")) != "t2" || string(v.GetStringBytes("error", "code")) != "type_mismatch" {
+		t.Errorf("version 2 error reply is '%s'", reply.Payload)
+	}
+}
+
+func TestRemoteErrorCode(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"toggle": contracts.Callable{
+			Argument: types.Null(),
+			Retval:   types.Bool(),
+			ErrHandler: func(a *fastjson.Arena, arg *fastjson.Value) (*fastjson.Value, error) {
+				return nil, codedError{}
+			},
+		},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	_, err := cl.Call(context.Background(), mqtt.Topic("svc/toggle"), q.Json(nil))
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Code != "broken_light" || rerr.Message != "the light is broken" {
+		t.Errorf("call failed with %v instead of the handler's error", err)
+	}
+}
+
+func TestConstraintViolation(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"set": contracts.Callable{
+			Argument: types.Struct(map[string]types.Type{
+				"level": types.Int().M(types.MetaData{types.MetaMin: fastjson.MustParse("0"), types.MetaMax: fastjson.MustParse("20")}),
+			}),
+			Retval: types.Null(),
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				return a.NewNull()
+			},
+		},
+	})
+	peer, replies := b.peer("_reply/#")
+
+	for _, level := range []string{"21", "3.7"} {
+		peer.Publish(mqtt.Message{
+			Topic:   mqtt.Topic("_call/things/svc/set"),
+			Payload: []byte(`{"version":2,"topic":"r","token":"t","argument":{"level":` + level + `}}`),
+		})
+		reply := receive(t, replies, "_reply/r")
+		_, data := parseReplyMessage(reply.Payload)
+		_, err := parseReply(data, nil)
+		var rerr *RemoteError
+		if !errors.As(err, &rerr) || rerr.Code != "type_mismatch" || len(rerr.Path) != 1 || rerr.Path[0] != "level" {
+			t.Errorf("level %s got the reply '%s'", level, reply.Payload)
+		}
+	}
+
+	peer.Publish(mqtt.Message{
+		Topic:   mqtt.Topic("_call/things/svc/set"),
+		Payload: []byte(`{"version":2,"topic":"r","token":"t","argument":{"level":20}}`),
+	})
+	expectReplyCode(t, replies, "")
+}
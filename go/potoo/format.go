@@ -0,0 +1,246 @@
+package potoo
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/dexterlb/potoo/go/potoo/codec"
+	"github.com/valyala/fastjson"
+)
+
+// Protocol versions of call and reply messages. Version 1 messages are
+// space-separated (`<reply topic> <token> <argument>` and
+// `<token> [result|error|chunk|end] <value>`, where the kind of JSON
+// results is omitted), and version 2 messages are JSON objects with a
+// "version" field, as described in protocol.md.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+)
+
+var messageParserPool fastjson.ParserPool
+
+// isObjectMessage tells if a call or reply is in the JSON object format.
+// Reply topics and tokens never start with "{".
+func isObjectMessage(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == '{'
+}
+
+func parseCallObject(payload []byte) (h callHeader) {
+	parser := messageParserPool.Get()
+	defer messageParserPool.Put(parser)
+
+	h.version = ProtocolV2
+	v, err := parser.ParseBytes(payload)
+	if err != nil || v.Type() != fastjson.TypeObject {
+		// the empty argument fails to parse later on
+		return
+	}
+
+	if version := v.GetInt("version"); version != 0 {
+		h.version = version
+	}
+	h.replyTopic = append([]byte(nil), v.GetStringBytes("topic")...)
+	h.token = append([]byte(nil), v.GetStringBytes("token")...)
+	h.identity = append([]byte(nil), v.GetStringBytes("caller")...)
+	h.signature = append([]byte(nil), v.GetStringBytes("signature")...)
+
+	// the signature covers these exactly as they were sent
+	h.timestamp = rawObjectField(payload, "timestamp")
+	h.argument = rawObjectField(payload, "argument")
+	if h.argument == nil {
+		h.argument = []byte("null")
+	}
+	return
+}
+
+// appendCallObject appends a version 2 call message with the fields of h
+func appendCallObject(buf []byte, h callHeader) []byte {
+	buf = append(buf, `{"version":2,"topic":`...)
+	buf = appendJSONString(buf, h.replyTopic)
+	buf = append(buf, `,"token":`...)
+	buf = appendJSONString(buf, h.token)
+	if h.identity != nil {
+		buf = append(buf, `,"caller":`...)
+		buf = appendJSONString(buf, h.identity)
+	}
+	if h.signature != nil {
+		buf = append(buf, `,"timestamp":`...)
+		buf = append(buf, h.timestamp...)
+		buf = append(buf, `,"signature":`...)
+		buf = appendJSONString(buf, h.signature)
+	}
+	buf = append(buf, `,"argument":`...)
+	buf = append(buf, h.argument...)
+	return append(buf, '}')
+}
+
+// rawObjectField returns the value of a top-level field of a JSON object
+// as it appears in data, or nil if there is no such field. data must be
+// valid JSON, and key must not need escaping.
+func rawObjectField(data []byte, key string) []byte {
+	i := skipJSONSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return nil
+	}
+	i++
+	for {
+		i = skipJSONSpace(data, i)
+		if i >= len(data) || data[i] != '"' {
+			return nil
+		}
+		keyEnd := skipJSONValue(data, i)
+		k := data[i+1 : keyEnd-1]
+
+		i = skipJSONSpace(data, keyEnd)
+		if i >= len(data) || data[i] != ':' {
+			return nil
+		}
+		start := skipJSONSpace(data, i+1)
+		end := skipJSONValue(data, start)
+		if string(k) == key {
+			return data[start:end]
+		}
+
+		i = skipJSONSpace(data, end)
+		if i >= len(data) || data[i] != ',' {
+			return nil
+		}
+		i++
+	}
+}
+
+func skipJSONSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\n' || data[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// skipJSONValue returns the index right after the value starting at i
+func skipJSONValue(data []byte, i int) int {
+	depth := 0
+	inString := false
+	for ; i < len(data); i++ {
+		ch := data[i]
+		switch {
+		case inString && ch == '\\':
+			i++
+		case inString && ch == '"':
+			inString = false
+			if depth == 0 {
+				return i + 1
+			}
+		case inString:
+		case ch == '"':
+			inString = true
+		case ch == '{' || ch == '[':
+			depth++
+		case ch == '}' || ch == ']':
+			if depth == 0 {
+				return i
+			}
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		case depth == 0 && (ch == ',' || ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'):
+			return i
+		}
+	}
+	return len(data)
+}
+
+// appendReplyHead appends the part of a reply which comes before its
+// value. kind is "result", "error", "chunk" or "end" (which has no value),
+// and enc is the encoding of the value. Version 1 replies omit the kind of
+// results only if they are JSON, since other encodings may begin with
+// anything, including the name of another kind.
+func appendReplyHead(buf []byte, version int, token []byte, kind string, enc codec.Codec) []byte {
+	if version < ProtocolV2 {
+		buf = append(buf, token...)
+		if kind != "result" || codec.Or(enc) != codec.JSON {
+			buf = append(buf, ' ')
+			buf = append(buf, kind...)
+		}
+		if kind != "end" {
+			buf = append(buf, ' ')
+		}
+		return buf
+	}
+
+	buf = append(buf, `{"version":2,"token":`...)
+	buf = appendJSONString(buf, token)
+	buf = append(buf, ",\""...)
+	buf = append(buf, kind...)
+	buf = append(buf, "\":"...)
+	if kind == "end" {
+		buf = append(buf, "true"...)
+	}
+	return buf
+}
+
+func appendReplyTail(buf []byte, version int) []byte {
+	if version < ProtocolV2 {
+		return buf
+	}
+	return append(buf, '}')
+}
+
+// parseReplyMessage splits a reply into its token and the version 1 form
+// of the rest: `[result] <value>`, `error <error>`, `chunk <value>` or
+// `end` (see splitReply)
+func parseReplyMessage(payload []byte) (token []byte, data []byte) {
+	if !isObjectMessage(payload) {
+		limitedSplit(payload, ' ', &token, &data)
+		return
+	}
+
+	parser := messageParserPool.Get()
+	defer messageParserPool.Put(parser)
+
+	v, err := parser.ParseBytes(payload)
+	if err != nil || v.Type() != fastjson.TypeObject {
+		return nil, nil
+	}
+	token = append([]byte(nil), v.GetStringBytes("token")...)
+
+	switch {
+	case v.Exists("error"):
+		data = v.Get("error").MarshalTo([]byte("error "))
+	case v.Exists("chunk"):
+		data = v.Get("chunk").MarshalTo([]byte("chunk "))
+	case v.GetBool("end"):
+		data = []byte("end")
+	case v.Exists("result"):
+		data = v.Get("result").MarshalTo(nil)
+	}
+	return
+}
+
+// splitReply splits the version 1 form of a reply into its kind and
+// value. enc is the encoding of the callable: only JSON results may come
+// without a kind, because no JSON value begins with the name of a kind.
+func splitReply(data []byte, enc codec.Codec) (kind string, value []byte) {
+	if codec.Or(enc) != codec.JSON {
+		var k []byte
+		limitedSplit(data, ' ', &k, &value)
+		return string(k), value
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("error ")):
+		return "error", data[len("error "):]
+	case bytes.HasPrefix(data, []byte("chunk ")):
+		return "chunk", data[len("chunk "):]
+	case bytes.Equal(data, []byte("end")):
+		return "end", nil
+	default:
+		return "result", data
+	}
+}
+
+func appendJSONString(buf []byte, s []byte) []byte {
+	quoted, _ := json.Marshal(string(s))
+	return append(buf, quoted...)
+}
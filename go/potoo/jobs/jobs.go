@@ -0,0 +1,240 @@
+// Package jobs implements callables which start long-running jobs. Each
+// job is mounted as a subcontract with "progress", "status" and "result"
+// values and a "cancel" callable while it runs, and is retired some time
+// after it finishes.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/bus"
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+const defaultRetention = 1 * time.Minute
+
+// Func performs a job and returns its result, which must be of the result
+// type given to Manager.Callable. It should report its progress via job
+// and give up when ctx is cancelled.
+type Func func(ctx context.Context, arena *fastjson.Arena, arg *fastjson.Value, job *Job) (*fastjson.Value, error)
+
+// Job is a job which has been started by a Manager
+type Job struct {
+	ID string
+
+	progress *bus.FloatBus
+	status   *bus.StringBus
+	result   *bus.JsonBus
+	cancel   context.CancelFunc
+	contract contracts.Contract
+}
+
+// SetProgress reports the progress of the job, from 0 to 1
+func (j *Job) SetProgress(p float64) {
+	j.progress.SendV(p)
+}
+
+// SetStatus reports what the job is doing. After the job finishes, its
+// status is one of "done", "cancelled" or "failed: <error>".
+func (j *Job) SetStatus(s string) {
+	j.status.SendV(s)
+}
+
+// Manager keeps track of jobs and their contracts
+type Manager struct {
+	// Retention is the time for which a finished job stays mounted so
+	// that its result can be read (one minute by default)
+	Retention time.Duration
+
+	onChange    func()
+	notifyMutex sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex sync.Mutex
+	jobs  map[string]*Job
+}
+
+// NewManager creates a job manager. onChange is called whenever a job is
+// mounted or retired, and should update the service contract (which is
+// expected to include Contract()). A job is mounted before the call which
+// started it returns, so onChange is called from the handler goroutine
+// of the (async) callable.
+func NewManager(onChange func()) *Manager {
+	m := &Manager{
+		onChange: onChange,
+		jobs:     make(map[string]*Job),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m
+}
+
+// Contract returns the contracts of the current jobs, keyed by job ID
+func (m *Manager) Contract() contracts.Map {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c := make(contracts.Map, len(m.jobs))
+	for id, job := range m.jobs {
+		c[id] = job.contract
+	}
+	return c
+}
+
+// Callable returns a callable which starts a job performed by fn and
+// returns its ID. The job's subcontract is mounted by the time the ID is
+// returned.
+func (m *Manager) Callable(argument types.Type, result types.Type, fn Func, subcontract contracts.Contract) contracts.Callable {
+	return contracts.Callable{
+		Argument:    argument,
+		Retval:      types.String(),
+		Subcontract: subcontract,
+		Async:       true, // onChange can't update the contract from the loop
+		ErrHandler: func(a *fastjson.Arena, arg *fastjson.Value) (*fastjson.Value, error) {
+			job, err := m.start(arg, result, fn)
+			if err != nil {
+				return nil, err
+			}
+			return a.NewString(job.ID), nil
+		},
+	}
+}
+
+// Stop cancels all running jobs
+func (m *Manager) Stop() {
+	m.cancel()
+}
+
+func (m *Manager) start(arg *fastjson.Value, resultType types.Type, fn Func) (*Job, error) {
+	if m.ctx.Err() != nil {
+		return nil, fmt.Errorf("job manager is stopped")
+	}
+
+	// the argument belongs to the caller, so we need a copy
+	arg, err := fastjson.ParseBytes(arg.MarshalTo(nil))
+	if err != nil {
+		return nil, fmt.Errorf("cannot copy argument: %s", err)
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate job ID: %s", err)
+	}
+
+	m.mutex.Lock()
+	job := &Job{
+		ID:       id,
+		progress: bus.NewFloatBus(0),
+		status:   bus.NewStringBus("running"),
+		result:   bus.New(q.Json(nil)),
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	job.cancel = cancel
+	job.contract = contracts.Map{
+		"progress": contracts.Value{
+			Type: types.Float().M(types.MetaData{"min": q.Float(0), "max": q.Float(1)}),
+			Bus:  job.progress,
+		},
+		"status": contracts.Value{
+			Type: types.String(),
+			Bus:  job.status,
+		},
+		"result": contracts.Value{
+			Type: types.Union(types.Null(), resultType),
+			Bus:  job.result,
+		},
+		"cancel": contracts.Callable{
+			Argument: types.Null(),
+			Retval:   types.Void(),
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				job.cancel()
+				return nil
+			},
+		},
+	}
+	m.jobs[job.ID] = job
+	m.mutex.Unlock()
+
+	m.notify()
+	go m.run(ctx, job, arg, resultType, fn)
+	return job, nil
+}
+
+// newID returns a random job ID, so that the IDs of jobs which were
+// started before a restart aren't reused
+func newID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (m *Manager) run(ctx context.Context, job *Job, arg *fastjson.Value, resultType types.Type, fn Func) {
+	defer job.cancel()
+	defer m.retire(job)
+
+	result, err := m.perform(ctx, job, arg, fn)
+	if err == nil {
+		err = types.TypeCheck(result, resultType)
+		if err != nil {
+			err = fmt.Errorf("job returned value of wrong type: %s", err)
+		}
+	}
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		job.SetStatus("cancelled")
+	case err != nil:
+		job.SetStatus(fmt.Sprintf("failed: %s", err))
+	default:
+		job.result.Send(result)
+		job.SetProgress(1)
+		job.SetStatus("done")
+	}
+}
+
+func (m *Manager) perform(ctx context.Context, job *Job, arg *fastjson.Value, fn Func) (result *fastjson.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	var arena fastjson.Arena
+	return fn(ctx, &arena, arg, job)
+}
+
+// retire unmounts the job after the retention period
+func (m *Manager) retire(job *Job) {
+	retention := m.Retention
+	if retention == 0 {
+		retention = defaultRetention
+	}
+
+	time.AfterFunc(retention, func() {
+		m.mutex.Lock()
+		delete(m.jobs, job.ID)
+		m.mutex.Unlock()
+
+		m.notify()
+	})
+}
+
+// notify calls onChange, one call at a time
+func (m *Manager) notify() {
+	m.notifyMutex.Lock()
+	defer m.notifyMutex.Unlock()
+
+	m.onChange()
+}
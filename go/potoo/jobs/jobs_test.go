@@ -0,0 +1,159 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+// watch returns a manager which reports the changes of the jobs' values
+// as "<field> <value>", and "mounted"/"retired" when the contract changes.
+// The values are subscribed to before the jobs start.
+func watch() (*Manager, <-chan string) {
+	events := make(chan string, 64)
+	mounted := make(map[string]bool)
+
+	var m *Manager
+	m = NewManager(func() {
+		jobs := m.Contract()
+		for id, job := range jobs {
+			if mounted[id] {
+				continue
+			}
+			mounted[id] = true
+			events <- "mounted"
+			for _, field := range []string{"progress", "status", "result"} {
+				field := field
+				job.(contracts.Map)[field].(contracts.Value).Bus.Subscribe(func(v *fastjson.Value) {
+					events <- field + " " + v.String()
+				})
+			}
+		}
+		for id := range mounted {
+			if _, ok := jobs[id]; !ok {
+				delete(mounted, id)
+				events <- "retired"
+			}
+		}
+	})
+	return m, events
+}
+
+func expectEvent(t *testing.T, events <-chan string, want string) {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		if !strings.HasPrefix(event, want) {
+			t.Errorf("got %s instead of %s", event, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("timed out waiting for %s", want)
+	}
+}
+
+func startJob(t *testing.T, m *Manager, fn Func) (string, contracts.Map) {
+	t.Helper()
+
+	callable := m.Callable(types.Null(), types.Int(), fn, nil)
+	var a fastjson.Arena
+	id, err := callable.ErrHandler(&a, q.Json(nil))
+	if err != nil {
+		t.Fatalf("unable to start job: %s", err)
+	}
+	job, ok := m.Contract()[string(id.GetStringBytes())]
+	if !ok {
+		t.Fatalf("job %s isn't mounted after it has been started", id)
+	}
+	return string(id.GetStringBytes()), job.(contracts.Map)
+}
+
+func TestJobDone(t *testing.T) {
+	m, events := watch()
+	m.Retention = 10 * time.Millisecond
+
+	release := make(chan struct{})
+	startJob(t, m, func(ctx context.Context, a *fastjson.Arena, arg *fastjson.Value, job *Job) (*fastjson.Value, error) {
+		job.SetProgress(0.5)
+		job.SetStatus("halfway")
+		<-release
+		return a.NewNumberInt(42), nil
+	})
+	expectEvent(t, events, "mounted")
+	expectEvent(t, events, "progress 0.5")
+	expectEvent(t, events, `status "halfway"`)
+
+	close(release)
+	expectEvent(t, events, "result 42")
+	expectEvent(t, events, "progress 1")
+	expectEvent(t, events, `status "done"`)
+	expectEvent(t, events, "retired")
+}
+
+func TestJobCancel(t *testing.T) {
+	m, events := watch()
+	wait := func(ctx context.Context, a *fastjson.Arena, arg *fastjson.Value, job *Job) (*fastjson.Value, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	_, job := startJob(t, m, wait)
+	expectEvent(t, events, "mounted")
+	var a fastjson.Arena
+	job["cancel"].(contracts.Callable).Handler(&a, q.Json(nil))
+	expectEvent(t, events, `status "cancelled"`)
+
+	startJob(t, m, wait)
+	expectEvent(t, events, "mounted")
+	m.Stop()
+	expectEvent(t, events, `status "cancelled"`)
+
+	_, err := m.Callable(types.Null(), types.Int(), wait, nil).ErrHandler(&a, q.Json(nil))
+	if err == nil {
+		t.Errorf("a stopped manager started a job")
+	}
+}
+
+func TestJobFailure(t *testing.T) {
+	m, events := watch()
+	for _, fn := range []Func{
+		func(ctx context.Context, a *fastjson.Arena, arg *fastjson.Value, job *Job) (*fastjson.Value, error) {
+			return nil, errors.New("oops")
+		},
+		func(ctx context.Context, a *fastjson.Arena, arg *fastjson.Value, job *Job) (*fastjson.Value, error) {
+			panic("oops")
+		},
+		func(ctx context.Context, a *fastjson.Arena, arg *fastjson.Value, job *Job) (*fastjson.Value, error) {
+			return a.NewString("not an int"), nil
+		},
+	} {
+		startJob(t, m, fn)
+		expectEvent(t, events, "mounted")
+		expectEvent(t, events, `status "failed: `)
+	}
+}
+
+func TestJobIDs(t *testing.T) {
+	m, events := watch()
+	seen := make(map[string]bool)
+	for i := 0; i < 16; i++ {
+		id, _ := startJob(t, m, func(ctx context.Context, a *fastjson.Arena, arg *fastjson.Value, job *Job) (*fastjson.Value, error) {
+			return a.NewNumberInt(1), nil
+		})
+		if seen[id] {
+			t.Fatalf("job ID %s was reused", id)
+		}
+		seen[id] = true
+		expectEvent(t, events, "mounted")
+		expectEvent(t, events, "result 1")
+		expectEvent(t, events, "progress 1")
+		expectEvent(t, events, `status "done"`)
+	}
+}
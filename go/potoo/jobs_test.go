@@ -0,0 +1,44 @@
+package potoo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/jobs"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+func TestJobMountedBeforeReply(t *testing.T) {
+	b := newFakeBroker()
+	var svc *Connection
+	var contract func() contracts.Contract
+	m := jobs.NewManager(func() {
+		svc.UpdateContract(contract())
+	})
+	defer m.Stop()
+	contract = func() contracts.Contract {
+		return contracts.Map{
+			"start": m.Callable(types.Null(), types.Int(), func(ctx context.Context, a *fastjson.Arena, arg *fastjson.Value, job *jobs.Job) (*fastjson.Value, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}, nil),
+			"jobs": m.Contract(),
+		}
+	}
+	svc = startService(t, b, ConnectionOptions{}, contract())
+	cl := startClient(t, b, ConnectionOptions{})
+
+	id, err := cl.Call(context.Background(), mqtt.Topic("svc/start"), q.Json(nil))
+	if err != nil {
+		t.Fatalf("unable to start job: %s", err)
+	}
+	cancel := mqtt.JoinTopics(mqtt.Topic("svc/jobs"), mqtt.Topic(id.GetStringBytes()), mqtt.Topic("cancel"))
+	_, err = cl.Call(context.Background(), cancel, q.Json(nil))
+	if err != nil {
+		t.Errorf("the job isn't available as soon as its ID is returned: %s", err)
+	}
+}
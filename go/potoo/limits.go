@@ -0,0 +1,188 @@
+package potoo
+
+import (
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/logging"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+)
+
+// maxCallerBuckets is the number of per-caller buckets after which the
+// full ones get forgotten
+const maxCallerBuckets = 1024
+
+type tokenBucket struct {
+	limit  contracts.RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit contracts.RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+	b.last = now
+}
+
+type callerBucketKey struct {
+	topic  string
+	caller string
+}
+
+// rateLimited tells if the call exceeds the rate limit of the callable or
+// the one for its caller, and takes a token from both buckets if it
+// doesn't. Anonymous callers are told apart by their reply topic.
+func (c *Connection) rateLimited(msg mqtt.Message, callable *contracts.Callable, caller Caller) bool {
+	now := time.Now()
+	buckets := c.callBuckets(msg, callable, caller, now)
+	if !tokensAvailable(buckets, now, nil) {
+		return true
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return false
+}
+
+// reserveTokens tells if the call is within the rate limits, counting the
+// tokens reserved by the calls checked before it (e.g. in the same batch),
+// and reserves a token in each bucket if it is. No tokens are taken.
+func (c *Connection) reserveTokens(msg mqtt.Message, callable *contracts.Callable, caller Caller, reserved map[*tokenBucket]int) bool {
+	now := time.Now()
+	buckets := c.callBuckets(msg, callable, caller, now)
+	if !tokensAvailable(buckets, now, reserved) {
+		return false
+	}
+	for _, b := range buckets {
+		reserved[b]++
+	}
+	return true
+}
+
+func tokensAvailable(buckets []*tokenBucket, now time.Time, reserved map[*tokenBucket]int) bool {
+	for _, b := range buckets {
+		b.refill(now)
+		if b.tokens-float64(reserved[b]) < 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// callBuckets returns the buckets which limit the call, creating them if
+// needed
+func (c *Connection) callBuckets(msg mqtt.Message, callable *contracts.Callable, caller Caller, now time.Time) []*tokenBucket {
+	var buckets []*tokenBucket
+
+	if callable.CallerRateLimit != nil {
+		id := caller.ID
+		if id == "" {
+			id = "reply:" + string(parseCallMessage(msg.Payload).replyTopic)
+		}
+		key := callerBucketKey{topic: string(msg.Topic), caller: id}
+		b, ok := c.callerBuckets[key]
+		if !ok {
+			c.forgetFullBuckets(now)
+			b = newTokenBucket(*callable.CallerRateLimit, now)
+			c.callerBuckets[key] = b
+		}
+		buckets = append(buckets, b)
+	}
+
+	if callable.RateLimit != nil {
+		b, ok := c.callableBuckets[string(msg.Topic)]
+		if !ok {
+			b = newTokenBucket(*callable.RateLimit, now)
+			c.callableBuckets[string(msg.Topic)] = b
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// forgetFullBuckets drops per-caller buckets which have refilled
+// completely (which is the same as not having them), if there are too many
+func (c *Connection) forgetFullBuckets(now time.Time) {
+	if len(c.callerBuckets) < maxCallerBuckets {
+		return
+	}
+	for key, b := range c.callerBuckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(c.callerBuckets, key)
+		}
+	}
+}
+
+// forgetBuckets drops the buckets of callables which are no longer served,
+// or whose limits have changed, given the callables before the update
+func (c *Connection) forgetBuckets(old map[string]*contracts.Callable) {
+	changed := func(topic string, limit func(*contracts.Callable) *contracts.RateLimit) bool {
+		before, ok := old[topic]
+		if !ok {
+			return true
+		}
+		after, ok := c.serviceCallableIndex[topic]
+		return !ok || !sameRateLimit(limit(before), limit(after))
+	}
+	callableLimit := func(c *contracts.Callable) *contracts.RateLimit { return c.RateLimit }
+	callerLimit := func(c *contracts.Callable) *contracts.RateLimit { return c.CallerRateLimit }
+
+	for topic := range c.callableBuckets {
+		if changed(topic, callableLimit) {
+			delete(c.callableBuckets, topic)
+		}
+	}
+	for key := range c.callerBuckets {
+		if changed(key.topic, callerLimit) {
+			delete(c.callerBuckets, key)
+		}
+	}
+}
+
+func sameRateLimit(a *contracts.RateLimit, b *contracts.RateLimit) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+type seenToken struct {
+	key  string
+	seen time.Time
+}
+
+// duplicateCall tells if a call with the same topic, reply topic and token
+// has been seen in the last DedupWindow (e.g. because the broker has
+// redelivered it)
+func (c *Connection) duplicateCall(msg mqtt.Message) bool {
+	if c.opts.DedupWindow == 0 {
+		return false
+	}
+	h := parseCallMessage(msg.Payload)
+	if len(h.token) == 0 {
+		return false
+	}
+
+	now := time.Now()
+	for len(c.seenTokenQueue) > 0 && now.Sub(c.seenTokenQueue[0].seen) > c.opts.DedupWindow {
+		delete(c.seenTokens, c.seenTokenQueue[0].key)
+		c.seenTokenQueue[0] = seenToken{}
+		c.seenTokenQueue = c.seenTokenQueue[1:]
+	}
+
+	key := string(msg.Topic) + " " + string(h.replyTopic) + " " + string(h.token)
+	if _, ok := c.seenTokens[key]; ok {
+		c.log.Debug("dropping duplicate call", logging.KeyTopic, string(msg.Topic), logging.KeyToken, string(h.token))
+		return true
+	}
+	c.seenTokens[key] = struct{}{}
+	c.seenTokenQueue = append(c.seenTokenQueue, seenToken{key: key, seen: now})
+	return false
+}
@@ -0,0 +1,142 @@
+package potoo
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+func limited(limit *contracts.RateLimit, callerLimit *contracts.RateLimit) contracts.Callable {
+	return contracts.Callable{
+		Argument:        types.Null(),
+		Retval:          types.Null(),
+		RateLimit:       limit,
+		CallerRateLimit: callerLimit,
+		Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+			return a.NewNull()
+		},
+	}
+}
+
+// expectCalls makes a call for each element of limited, and checks if it
+// is rate limited
+func expectCalls(t *testing.T, cl *Connection, limited ...bool) {
+	t.Helper()
+
+	for i, want := range limited {
+		_, err := cl.Call(context.Background(), mqtt.Topic("svc/ping"), q.Json(nil))
+		var rerr *RemoteError
+		got := errors.As(err, &rerr) && rerr.Code == "rate_limited"
+		if got != want || (!got && err != nil) {
+			t.Errorf("call %d returned %v", i, err)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"ping": limited(&contracts.RateLimit{Rate: 0.001, Burst: 2}, nil),
+	})
+	expectCalls(t, startClient(t, b, ConnectionOptions{}), false, false, true)
+}
+
+func TestCallerRateLimit(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"ping": limited(&contracts.RateLimit{Rate: 5, Burst: 1}, &contracts.RateLimit{Rate: 0.001, Burst: 2}),
+	})
+	alice := startClient(t, b, ConnectionOptions{Identity: "alice"})
+	bob := startClient(t, b, ConnectionOptions{Identity: "bob"})
+
+	// the second call is refused by the callable's limit, and doesn't use
+	// up alice's tokens
+	expectCalls(t, alice, false, true)
+	time.Sleep(300 * time.Millisecond)
+	expectCalls(t, alice, false)
+	time.Sleep(300 * time.Millisecond)
+	expectCalls(t, alice, true)
+	expectCalls(t, bob, false)
+}
+
+func TestRateLimitContractUpdate(t *testing.T) {
+	b := newFakeBroker()
+	svc := startService(t, b, ConnectionOptions{}, contracts.Map{
+		"ping": limited(&contracts.RateLimit{Rate: 0.001, Burst: 1}, nil),
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+	expectCalls(t, cl, false, true)
+
+	svc.UpdateContract(contracts.Map{
+		"ping": limited(&contracts.RateLimit{Rate: 0.001, Burst: 1}, nil),
+		"pong": limited(nil, nil),
+	})
+	eventually(t, "the client sees the new contract", func() bool {
+		cl.remoteMutex.Lock()
+		defer cl.remoteMutex.Unlock()
+		_, ok := cl.remoteCallables["svc/pong"]
+		return ok
+	})
+	expectCalls(t, cl, true)
+
+	svc.UpdateContract(contracts.Map{
+		"ping": limited(&contracts.RateLimit{Rate: 0.001, Burst: 2}, nil),
+	})
+	eventually(t, "the client sees the changed contract", func() bool {
+		cl.remoteMutex.Lock()
+		defer cl.remoteMutex.Unlock()
+		_, ok := cl.remoteCallables["svc/pong"]
+		return !ok
+	})
+	expectCalls(t, cl, false, false, true)
+}
+
+func TestDedupWindow(t *testing.T) {
+	b := newFakeBroker()
+	window := 200 * time.Millisecond
+	var calls int32
+	startService(t, b, ConnectionOptions{DedupWindow: window}, contracts.Map{
+		"count": contracts.Callable{
+			Argument: types.Null(),
+			Retval:   types.Int(),
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				return a.NewNumberInt(int(atomic.AddInt32(&calls, 1)))
+			},
+		},
+	})
+	peer, replies := b.peer("_reply/#")
+	call := func(token string) {
+		peer.Publish(mqtt.Message{Topic: mqtt.Topic("_call/things/svc/count"), Payload: []byte("r " + token + " null")})
+	}
+	expectReply := func(token string, n int) {
+		t.Helper()
+		reply := receive(t, replies, "_reply/r")
+		got, data := parseReplyMessage(reply.Payload)
+		if string(got) != token || string(data) != strconv.Itoa(n) {
+			t.Errorf("got reply '%s' instead of %d for %s", reply.Payload, n, token)
+		}
+	}
+
+	// the redelivered call is dropped, so the next reply is the one to t2
+	call("t1")
+	call("t1")
+	call("t2")
+	expectReply("t1", 1)
+	expectReply("t2", 2)
+
+	time.Sleep(window + 50*time.Millisecond)
+	call("t1")
+	expectReply("t1", 3)
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("the handler was called %d times", n)
+	}
+}
@@ -0,0 +1,124 @@
+// Package logging defines the logger used throughout potoo. Its interface
+// is a subset of the one of *slog.Logger, which can be used directly.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger logs messages with a list of alternating keys and values, e.g.
+//
+//	l.Info("call handled", KeyTopic, "foo/bar", KeyLatency, 42*time.Millisecond)
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// common keys of logged fields
+const (
+	KeyTopic    = "topic"
+	KeyService  = "service"
+	KeyToken    = "token"
+	KeyLatency  = "latency"
+	KeyError    = "error"
+	KeyCategory = "category"
+	KeyPayload  = "payload"
+	KeyAttempt  = "attempt"
+	KeyDelay    = "delay"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+// Nop discards everything
+var Nop Logger = nop{}
+
+type nop struct{}
+
+func (nop) Debug(msg string, args ...interface{}) {}
+func (nop) Info(msg string, args ...interface{})  {}
+func (nop) Warn(msg string, args ...interface{})  {}
+func (nop) Error(msg string, args ...interface{}) {}
+
+// Std returns a logger which writes messages of at least the given level
+// to a standard library logger (or to the default one, if l is nil), in
+// the form "LEVEL msg key=value key=value"
+func Std(l *log.Logger, level Level) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &std{logger: l, level: level}
+}
+
+type std struct {
+	logger *log.Logger
+	level  Level
+}
+
+func (s *std) Debug(msg string, args ...interface{}) { s.log(LevelDebug, msg, args) }
+func (s *std) Info(msg string, args ...interface{})  { s.log(LevelInfo, msg, args) }
+func (s *std) Warn(msg string, args ...interface{})  { s.log(LevelWarn, msg, args) }
+func (s *std) Error(msg string, args ...interface{}) { s.log(LevelError, msg, args) }
+
+func (s *std) log(level Level, msg string, args []interface{}) {
+	if level < s.level {
+		return
+	}
+	s.logger.Print(Format(level, msg, args...))
+}
+
+// Format formats a message like the loggers returned by Std
+func Format(level Level, msg string, args ...interface{}) string {
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		b.WriteByte(' ')
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, "!BADKEY=%v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, "%v=", args[i])
+		value := fmt.Sprint(args[i+1])
+		if strings.ContainsAny(value, " =\"") || value == "" {
+			fmt.Fprintf(&b, "%q", value)
+		} else {
+			b.WriteString(value)
+		}
+	}
+	return b.String()
+}
+
+// Or returns l, or Nop if l is nil
+func Or(l Logger) Logger {
+	if l == nil {
+		return Nop
+	}
+	return l
+}
@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		level Level
+		msg   string
+		args  []interface{}
+		want  string
+	}{
+		{LevelInfo, "connected", nil, "INFO connected"},
+		{LevelDebug, "call", []interface{}{KeyTopic, "foo/bar", KeyLatency, 42 * time.Millisecond}, "DEBUG call topic=foo/bar latency=42ms"},
+		{LevelWarn, "rejected", []interface{}{KeyError, "too many calls"}, `WARN rejected error="too many calls"`},
+		{LevelError, "failed", []interface{}{KeyToken, ""}, `ERROR failed token=""`},
+		{LevelError, "failed", []interface{}{KeyTopic}, "ERROR failed !BADKEY=topic"},
+		{Level(7), "odd", nil, "LEVEL(7) odd"},
+	}
+	for _, test := range tests {
+		got := Format(test.level, test.msg, test.args...)
+		if got != test.want {
+			t.Errorf("Format(%s, %q, %v) = %q, want %q", test.level, test.msg, test.args, got, test.want)
+		}
+	}
+}
+
+func TestStdLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := Std(log.New(&buf, "", 0), LevelInfo)
+
+	l.Debug("hidden")
+	l.Info("shown", KeyService, "lamp")
+	l.Error("also shown")
+
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(got) != 2 || got[0] != "INFO shown service=lamp" || got[1] != "ERROR also shown" {
+		t.Errorf("logged %q", got)
+	}
+}
+
+func TestOr(t *testing.T) {
+	if Or(nil) != Nop {
+		t.Errorf("Or(nil) isn't Nop")
+	}
+	l := Std(nil, LevelDebug)
+	if Or(l) != l {
+		t.Errorf("Or doesn't return the given logger")
+	}
+}
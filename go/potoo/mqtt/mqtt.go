@@ -3,6 +3,12 @@ package mqtt
 type Topic []byte
 
 type ConnectConfig struct {
+	// ClientID is the MQTT client ID to connect with. If empty, the
+	// client uses its own setting.
+	ClientID string
+
+	// OnDisconnect receives at most one error when the connection is lost,
+	// and gets closed when the connection ends
 	OnDisconnect chan<- error
 	OnMessage    chan<- Message
 	WillMessage  Message
@@ -25,9 +31,16 @@ type Client interface {
 	Disconnect()
 }
 
+// ClientIDProvider is implemented by clients which may have a client ID
+// configured in their own options. potoo uses it instead of deriving one.
+type ClientIDProvider interface {
+	ConfiguredClientID() string
+}
+
 func (c *ConnectConfig) Copy() *ConnectConfig {
 	msg := c.WillMessage.Copy()
 	return &ConnectConfig{
+		ClientID:     c.ClientID,
 		OnDisconnect: c.OnDisconnect,
 		OnMessage:    c.OnMessage,
 		WillMessage:  *msg,
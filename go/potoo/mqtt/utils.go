@@ -1,5 +1,12 @@
 package mqtt
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
 func JoinTopics(topics ...Topic) Topic {
 	var b []byte
 
@@ -14,8 +21,9 @@ func JoinTopics(topics ...Topic) Topic {
 				b = append(b, lastc)
 			}
 		}
-		if lastc != byte('/') {
-			b = append(b, byte('/'))
+		if len(b) > 0 && lastc != byte('/') {
+			lastc = byte('/')
+			b = append(b, lastc)
 		}
 	}
 
@@ -25,3 +33,87 @@ func JoinTopics(topics ...Topic) Topic {
 
 	return Topic(b[:len(b)-1])
 }
+
+// StripTopic removes prefix from the start of topic. The second return value
+// is false if topic doesn't start with prefix.
+func StripTopic(prefix Topic, topic Topic) (Topic, bool) {
+	prefix = JoinTopics(prefix)
+	topic = JoinTopics(topic)
+
+	if len(prefix) == 0 {
+		return topic, true
+	}
+	if len(topic) < len(prefix) || string(topic[:len(prefix)]) != string(prefix) {
+		return nil, false
+	}
+	if len(topic) == len(prefix) {
+		return Topic{}, true
+	}
+	if topic[len(prefix)] != byte('/') {
+		return nil, false
+	}
+	return topic[len(prefix)+1:], true
+}
+
+// CheckKey tells if key can be used as a single topic level: it must be
+// non-empty valid UTF-8 without "/", "+", "#" or NUL characters. Keys
+// which don't pass can be escaped with EscapeKey.
+func CheckKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("key is empty")
+	}
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("key '%s' is not valid UTF-8", key)
+	}
+	if i := strings.IndexAny(key, "/+#\x00"); i >= 0 {
+		return fmt.Errorf("key '%s' contains '%c'", key, key[i])
+	}
+	return nil
+}
+
+// EscapeKey turns an arbitrary string into a valid topic level, which
+// UnescapeKey turns back into the same string. "%", "/", "+", "#", NUL
+// and bytes which aren't valid UTF-8 are percent-encoded, and the empty
+// string becomes "%". Other keys which pass CheckKey are unchanged.
+func EscapeKey(key string) string {
+	if key == "" {
+		return "%"
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(key); {
+		r, size := utf8.DecodeRuneInString(key[i:])
+		if (r == utf8.RuneError && size == 1) || strings.ContainsRune("%/+#\x00", r) {
+			fmt.Fprintf(&b, "%%%02X", key[i])
+		} else {
+			b.WriteString(key[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// UnescapeKey reverses EscapeKey
+func UnescapeKey(level string) (string, error) {
+	if level == "%" {
+		return "", nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(level); i++ {
+		if level[i] != '%' {
+			b.WriteByte(level[i])
+			continue
+		}
+		if i+2 >= len(level) {
+			return "", fmt.Errorf("truncated escape sequence in '%s'", level)
+		}
+		n, err := strconv.ParseUint(level[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in '%s'", level)
+		}
+		b.WriteByte(byte(n))
+		i += 2
+	}
+	return b.String(), nil
+}
@@ -32,4 +32,83 @@ func TestJoinTopics(t *testing.T) {
 	jt("foo//bar/", "baz", "foo/bar/baz")
 	jt("foo//bar/", "baz/", "foo/bar/baz")
 	jt("foo//bar/", "baz/", "/", "foo/bar/baz")
+	jt("foo/bar", "", "foo/bar")
+	jt("", "foo", "", "foo")
+}
+
+func TestStripTopic(t *testing.T) {
+	st := func(prefix string, topic string, result string, ok bool) {
+		stripped, stripOk := StripTopic(Topic(prefix), Topic(topic))
+
+		if stripOk != ok || string(stripped) != result {
+			t.Errorf(
+				"stripping '%s' from '%s' produced ('%s', %v) instead of ('%s', %v)",
+				prefix, topic,
+				string(stripped), stripOk,
+				result, ok,
+			)
+		}
+	}
+
+	st("foo", "foo/bar", "bar", true)
+	st("/foo/", "foo/bar/baz", "bar/baz", true)
+	st("foo/bar", "foo/bar", "", true)
+	st("", "foo/bar", "foo/bar", true)
+	st("foo", "foobar", "", false)
+	st("foo/bar", "foo", "", false)
+	st("baz", "foo/bar", "", false)
+}
+
+func TestCheckKey(t *testing.T) {
+	ck := func(key string, ok bool) {
+		err := CheckKey(key)
+
+		if (err == nil) != ok {
+			t.Errorf("checking '%s' produced %v, expected ok = %v", key, err, ok)
+		}
+	}
+
+	ck("foo", true)
+	ck("foo bar.baz-42", true)
+	ck("ünicode", true)
+	ck("$foo", true)
+	ck("", false)
+	ck("foo/bar", false)
+	ck("foo+", false)
+	ck("#", false)
+	ck("foo\x00", false)
+	ck("\xff", false)
+}
+
+func TestEscapeKey(t *testing.T) {
+	ek := func(key string, escaped string) {
+		result := EscapeKey(key)
+		if result != escaped {
+			t.Errorf("escaping '%s' produced '%s' instead of '%s'", key, result, escaped)
+		}
+		if err := CheckKey(result); err != nil {
+			t.Errorf("escaping '%s' produced an invalid key: %s", key, err)
+		}
+
+		unescaped, err := UnescapeKey(result)
+		if err != nil || unescaped != key {
+			t.Errorf("unescaping '%s' produced ('%s', %v) instead of '%s'", result, unescaped, err, key)
+		}
+	}
+
+	ek("foo", "foo")
+	ek("ünicode", "ünicode")
+	ek("", "%")
+	ek("%", "%25")
+	ek("foo/bar", "foo%2Fbar")
+	ek("+#", "%2B%23")
+	ek("a\x00b", "a%00b")
+	ek("\xffü", "%FFü")
+	ek("100%/2", "100%25%2F2")
+
+	for _, level := range []string{"%2", "foo%", "%zz", "%+1"} {
+		if _, err := UnescapeKey(level); err == nil {
+			t.Errorf("unescaping '%s' should have failed", level)
+		}
+	}
 }
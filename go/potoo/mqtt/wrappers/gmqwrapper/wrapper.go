@@ -1,26 +1,39 @@
 package wrappers
 
 import (
-	"fmt"
-	"os"
 	"sync"
 	"time"
 
+	"github.com/dexterlb/potoo/go/potoo/logging"
 	"github.com/dexterlb/potoo/go/potoo/mqtt"
 	"github.com/yosssi/gmq/mqtt/client"
 )
 
 type Opts struct {
+	// ConnectOptions.ClientID is used unless ConnectionOptions.ClientID
+	// is set
 	client.ConnectOptions
-	DefaultQos   byte
-	Debug        func(string)
+	DefaultQos byte
+	Logger     logging.Logger
+
+	// ErrorHandler is called with the errors of the MQTT client. Each
+	// error also ends the connection, which is reported to potoo instead
+	// of crashing the program.
 	ErrorHandler func(error)
 }
 
 type Wrapper struct {
-	opts     *Opts
-	cli      *client.Client
-	connConf *mqtt.ConnectConfig
+	opts *Opts
+	cli  *client.Client
+	conn *connection
+}
+
+// connection is the state of a single Connect() call. The callbacks of
+// each client hold on to their own connection, so that a terminated
+// client can't report to the channels of the next one.
+type connection struct {
+	conf           *mqtt.ConnectConfig
+	disconnectOnce sync.Once
 }
 
 func NewWrapper(opts *Opts) *Wrapper {
@@ -29,21 +42,34 @@ func NewWrapper(opts *Opts) *Wrapper {
 	}
 }
 
-func (g *Wrapper) handleError(err error) {
-	g.debug("MQTT error: %s", err)
-	panic(err)
+func (g *Wrapper) handleError(conn *connection, err error) {
+	g.log().Error("MQTT error", logging.KeyError, err)
 	if g.opts.ErrorHandler != nil {
 		g.opts.ErrorHandler(err)
 	}
-	g.connConf.OnDisconnect <- err
+	conn.disconnected(err)
+}
+
+// disconnected reports the end of the connection (with an error, if
+// not nil) exactly once
+func (conn *connection) disconnected(err error) {
+	onDisconnect := conn.conf.OnDisconnect
+	conn.disconnectOnce.Do(func() {
+		if err != nil {
+			onDisconnect <- err
+		}
+		close(onDisconnect)
+	})
 }
 
-func (g *Wrapper) handleMessage(topic []byte, payload []byte) {
-	g.debug(" <- %s : %s", string(topic), string(payload))
-	g.connConf.OnMessage <- mqtt.Message{
-		Topic:   topic,
-		Payload: payload,
-		Retain:  false, // TODO: although not very useful, it would be nice to get this
+func (g *Wrapper) messageHandler(conn *connection) func(topic []byte, payload []byte) {
+	return func(topic []byte, payload []byte) {
+		g.log().Debug("received", logging.KeyTopic, string(topic), logging.KeyPayload, string(payload))
+		conn.conf.OnMessage <- mqtt.Message{
+			Topic:   topic,
+			Payload: payload,
+			Retain:  false, // TODO: although not very useful, it would be nice to get this
+		}
 	}
 }
 
@@ -53,7 +79,7 @@ func (g *Wrapper) Publish(m mqtt.Message) {
 	// time after it exits
 	payload := append([]byte(nil), m.Payload...)
 
-	g.debug(" -> %s : %s", string(m.Topic), string(m.Payload))
+	g.log().Debug("publishing", logging.KeyTopic, string(m.Topic), logging.KeyPayload, string(m.Payload))
 	var popts client.PublishOptions
 	popts.QoS = g.opts.DefaultQos
 	popts.Retain = m.Retain
@@ -61,53 +87,64 @@ func (g *Wrapper) Publish(m mqtt.Message) {
 	popts.Message = payload
 	err := g.cli.Publish(&popts)
 	if err != nil {
-		g.handleError(err)
+		g.handleError(g.conn, err)
 	}
 }
 
 func (g *Wrapper) Subscribe(filter mqtt.Topic) {
-	g.debug("Subscribe %s", string(filter))
+	g.log().Debug("subscribing", logging.KeyTopic, string(filter))
 	// TODO: maybe make this take a slice of filters and subscribe at once
 	err := g.cli.Subscribe(&client.SubscribeOptions{
 		SubReqs: []*client.SubReq{
 			{
 				TopicFilter: filter,
 				QoS:         g.opts.DefaultQos,
-				Handler:     g.handleMessage,
+				Handler:     g.messageHandler(g.conn),
 			},
 		},
 	})
 	if err != nil {
-		g.handleError(err)
+		g.handleError(g.conn, err)
 	}
 }
 
 func (g *Wrapper) Unsubscribe(filter mqtt.Topic) {
-	g.debug("unsubscribe %s", string(filter))
+	g.log().Debug("unsubscribing", logging.KeyTopic, string(filter))
 	// TODO: maybe make this take a slice of filters and unsubscribe at once
 	err := g.cli.Unsubscribe(&client.UnsubscribeOptions{
 		TopicFilters: [][]byte{filter},
 	})
 	if err != nil {
-		g.handleError(err)
+		g.handleError(g.conn, err)
 	}
 }
 
+// ConfiguredClientID returns Opts.ClientID
+func (g *Wrapper) ConfiguredClientID() string {
+	return string(g.opts.ClientID)
+}
+
 func (g *Wrapper) Connect(config *mqtt.ConnectConfig) error {
-	g.debug("connect with will %s : %s", string(config.WillMessage.Topic), string(config.WillMessage.Payload))
+	g.log().Debug("connecting", "will_topic", string(config.WillMessage.Topic), "will_payload", string(config.WillMessage.Payload))
 	g.opts.WillTopic = append([]byte(nil), config.WillMessage.Topic...)
 	g.opts.WillMessage = append([]byte(nil), config.WillMessage.Payload...)
 	g.opts.WillRetain = config.WillMessage.Retain
 	g.opts.WillQoS = g.opts.DefaultQos
+	if config.ClientID != "" {
+		g.opts.ClientID = []byte(config.ClientID)
+	}
 
 	if g.cli != nil {
-		panic("trying to call Connect() on a  wrapper that has already been connected")
+		// reconnecting after the previous connection has been lost
+		g.cli.Terminate()
 	}
+	conn := &connection{conf: config.Copy()}
 	g.cli = client.New(&client.Options{
-		ErrorHandler: g.handleError,
+		ErrorHandler: func(err error) {
+			g.handleError(conn, err)
+		},
 	})
-
-	g.connConf = config
+	g.conn = conn
 
 	return g.cli.Connect(&g.opts.ConnectOptions)
 }
@@ -150,7 +187,7 @@ func (g *Wrapper) DisconnectWithWill() {
 		time.Sleep(2 * time.Second)
 		once.Do(func() {
 			close(sentWill) // timeout
-			fmt.Fprintf(os.Stderr, "*** FIXME *** timing out a MQTT will\n")
+			g.log().Warn("timed out waiting for the will message to be sent")
 		})
 	}()
 
@@ -161,12 +198,10 @@ func (g *Wrapper) DisconnectWithWill() {
 
 func (g *Wrapper) Disconnect() {
 	g.cli.Disconnect()
-	g.debug("Disconnecting")
-	close(g.connConf.OnDisconnect)
+	g.log().Debug("disconnected")
+	g.conn.disconnected(nil)
 }
 
-func (g *Wrapper) debug(s string, args ...interface{}) {
-	if g.opts.Debug != nil {
-		g.opts.Debug(fmt.Sprintf(s, args...))
-	}
+func (g *Wrapper) log() logging.Logger {
+	return logging.Or(g.opts.Logger)
 }
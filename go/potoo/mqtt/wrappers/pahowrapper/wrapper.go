@@ -2,28 +2,39 @@ package pahowrapper
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/dexterlb/potoo/go/potoo/logging"
 	"github.com/dexterlb/potoo/go/potoo/mqtt"
 	paho "github.com/eclipse/paho.mqtt.golang"
 )
 
 type Opts struct {
 	BrokerHostname      string
-	ClientID            string
+	ClientID            string // used unless ConnectionOptions.ClientID is set
 	Qos                 int
 	DisconnectTimeoutMs uint
-	DebugLogger         paho.Logger
-	WarnLogger          paho.Logger
-	ErrorLogger         paho.Logger
-	CriticalLogger      paho.Logger
-	ErrorHandler        func(error)
+	Logger              logging.Logger // also receives paho's own messages
+
+	// ErrorHandler is called with the errors of the MQTT client. Each
+	// error also ends the connection, which is reported to potoo.
+	ErrorHandler func(error)
 }
 
 type Wrapper struct {
-	opts     *Opts
-	client   paho.Client
-	connConf *mqtt.ConnectConfig
+	opts   *Opts
+	client paho.Client
+	conn   *connection
+}
+
+// connection is the state of a single Connect() call. The callbacks of
+// each client hold on to their own connection, so that an old client
+// can't report to the channels of the next one.
+type connection struct {
+	conf           *mqtt.ConnectConfig
+	disconnectOnce sync.Once
 }
 
 func New(opts *Opts) *Wrapper {
@@ -32,28 +43,39 @@ func New(opts *Opts) *Wrapper {
 	}
 }
 
-func (p *Wrapper) handleError(err error) {
-	p.debug("MQTT error: %s", err)
+func (p *Wrapper) handleError(conn *connection, err error) {
+	p.log().Error("MQTT error", logging.KeyError, err)
 	if p.opts.ErrorHandler != nil {
 		p.opts.ErrorHandler(err)
 	}
-	p.connConf.OnDisconnect <- err
-	close(p.connConf.OnDisconnect)
+	conn.disconnected(err)
+}
+
+// disconnected reports the end of the connection (with an error, if
+// not nil) exactly once
+func (conn *connection) disconnected(err error) {
+	onDisconnect := conn.conf.OnDisconnect
+	conn.disconnectOnce.Do(func() {
+		if err != nil {
+			onDisconnect <- err
+		}
+		close(onDisconnect)
+	})
 }
 
 func (p *Wrapper) handleToken(token paho.Token) {
 	err := unwrap(token)
 	if err != nil {
-		p.handleError(err)
+		p.handleError(p.conn, err)
 	}
 }
 
-func (p *Wrapper) handleMessage(_client paho.Client, pahoMsg paho.Message) {
+func (p *Wrapper) handleMessage(conn *connection, pahoMsg paho.Message) {
 	topic := pahoMsg.Topic()
 	payload := pahoMsg.Payload()
 	retained := pahoMsg.Retained()
 
-	p.debug(" <- %s : %s", topic, string(payload))
+	p.log().Debug("received", logging.KeyTopic, topic, logging.KeyPayload, string(payload))
 	msg := mqtt.Message{
 		Topic:   []byte(topic),
 		Payload: payload,
@@ -63,51 +85,66 @@ func (p *Wrapper) handleMessage(_client paho.Client, pahoMsg paho.Message) {
 	// we use a goroutine here just to be safe (paho doesn't like its handler to block)
 	// maybe a buffered channel would be better?
 	go func() {
-		if p.connConf.OnMessage != nil {
-			p.connConf.OnMessage <- msg
+		if conn.conf.OnMessage != nil {
+			conn.conf.OnMessage <- msg
 		}
 	}()
 }
 
 func (p *Wrapper) Publish(m mqtt.Message) {
-	p.debug(" -> %s : %s", string(m.Topic), string(m.Payload))
+	p.log().Debug("publishing", logging.KeyTopic, string(m.Topic), logging.KeyPayload, string(m.Payload))
 	p.handleToken(
 		p.client.Publish(string(m.Topic), byte(p.opts.Qos), m.Retain, m.Payload),
 	)
 }
 
 func (p *Wrapper) Subscribe(filter mqtt.Topic) {
-	p.debug("Subscribe %s", string(filter))
+	p.log().Debug("subscribing", logging.KeyTopic, string(filter))
 	p.handleToken(
 		p.client.Subscribe(string(filter), byte(p.opts.Qos), nil),
 	)
 }
 
 func (p *Wrapper) Unsubscribe(filter mqtt.Topic) {
-	p.debug("unsubscribe %s", string(filter))
+	p.log().Debug("unsubscribing", logging.KeyTopic, string(filter))
 	p.handleToken(
 		p.client.Unsubscribe(string(filter)),
 	)
 }
 
-func (p *Wrapper) Connect(connConf *mqtt.ConnectConfig) error {
-	p.connConf = connConf.Copy()
+// ConfiguredClientID returns Opts.ClientID
+func (p *Wrapper) ConfiguredClientID() string {
+	return p.opts.ClientID
+}
 
-	paho.DEBUG = p.opts.DebugLogger
-	paho.CRITICAL = p.opts.CriticalLogger
-	paho.WARN = p.opts.WarnLogger
-	paho.ERROR = p.opts.ErrorLogger
-	p.debug("connect with will %s : %s", string(connConf.WillMessage.Topic), string(connConf.WillMessage.Payload))
+func (p *Wrapper) Connect(connConf *mqtt.ConnectConfig) error {
+	conn := &connection{conf: connConf.Copy()}
+	p.conn = conn
+
+	if p.opts.Logger != nil {
+		paho.DEBUG = pahoLogger(p.opts.Logger.Debug)
+		paho.WARN = pahoLogger(p.opts.Logger.Warn)
+		paho.ERROR = pahoLogger(p.opts.Logger.Error)
+		paho.CRITICAL = pahoLogger(p.opts.Logger.Error)
+	}
+	p.log().Debug("connecting", "will_topic", string(connConf.WillMessage.Topic), "will_payload", string(connConf.WillMessage.Payload))
 
 	opts := paho.NewClientOptions()
 	opts.AddBroker(p.opts.BrokerHostname)
-	opts.SetClientID(p.opts.ClientID)
+	clientID := connConf.ClientID
+	if clientID == "" {
+		clientID = p.opts.ClientID
+	}
+	opts.SetClientID(clientID)
 
+	opts.SetAutoReconnect(false) // reconnecting is done by potoo
 	opts.SetKeepAlive(60 * time.Second)
-	opts.SetDefaultPublishHandler(p.handleMessage)
+	opts.SetDefaultPublishHandler(func(_client paho.Client, msg paho.Message) {
+		p.handleMessage(conn, msg)
+	})
 	opts.SetPingTimeout(1 * time.Second)
 	opts.SetConnectionLostHandler(func(client paho.Client, err error) {
-		p.handleError(fmt.Errorf("lost connection: %w", err))
+		p.handleError(conn, fmt.Errorf("lost connection: %w", err))
 	})
 
 	opts.WillEnabled = true
@@ -121,8 +158,9 @@ func (p *Wrapper) Connect(connConf *mqtt.ConnectConfig) error {
 }
 
 func (p *Wrapper) DisconnectWithWill() {
-	p.debug("will send will message: %s : %s", string(p.connConf.WillMessage.Topic), string(p.connConf.WillMessage.Payload))
-	p.Publish(p.connConf.WillMessage)
+	will := p.conn.conf.WillMessage
+	p.log().Debug("sending will message", logging.KeyTopic, string(will.Topic), logging.KeyPayload, string(will.Payload))
+	p.Publish(will)
 	p.Disconnect()
 }
 
@@ -133,10 +171,22 @@ func (p *Wrapper) Disconnect() {
 	}
 
 	p.client.Disconnect(timeout)
+	p.conn.disconnected(nil)
+}
+
+func (p *Wrapper) log() logging.Logger {
+	return logging.Or(p.opts.Logger)
+}
+
+// pahoLogger adapts a logging method to the logger interface of paho
+type pahoLogger func(msg string, args ...interface{})
+
+func (l pahoLogger) Println(v ...interface{}) {
+	l(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
 }
 
-func (p *Wrapper) debug(s string, args ...interface{}) {
-	p.opts.DebugLogger.Printf(s, args...)
+func (l pahoLogger) Printf(format string, v ...interface{}) {
+	l(fmt.Sprintf(format, v...))
 }
 
 func unwrap(token paho.Token) error {
@@ -1,13 +1,17 @@
 package potoo
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/dexterlb/potoo/go/potoo/bus"
+	"github.com/dexterlb/potoo/go/potoo/codec"
 	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/logging"
 	"github.com/dexterlb/potoo/go/potoo/mqtt"
 	"github.com/dexterlb/potoo/go/potoo/types"
 	"github.com/valyala/fastjson"
@@ -17,12 +21,115 @@ type ConnectionOptions struct {
 	MqttClient  mqtt.Client
 	Root        mqtt.Topic
 	ServiceRoot mqtt.Topic
-	OnContract  func(mqtt.Topic, contracts.Contract)
 	CallTimeout time.Duration
+
+	// Reconnect makes the connection recover from a lost broker connection
+	// instead of failing. If nil, Loop returns an error when the
+	// connection is lost.
+	Reconnect *ReconnectPolicy
+
+	// DiscoverServices makes the connection track the contracts of all
+	// services under Root (see Services). It is implied by OnContract.
+	DiscoverServices bool
+
+	// OnContract is called with the service root and the decoded contract
+	// whenever a service publishes its contract, and with a nil contract
+	// when the service goes away or publishes a contract which can't be
+	// used. It is called from a separate goroutine.
+	OnContract func(mqtt.Topic, contracts.Contract)
+
+	// CompetitionPolicy tells what to do when another service publishes
+	// on our contract topic. CompetitionDelay is the time to wait before
+	// retrying with CompetitionBackOff (defaults to 10 seconds).
+	CompetitionPolicy CompetitionPolicy
+	CompetitionDelay  time.Duration
+
+	// OnError is called (from a separate goroutine) with errors which
+	// happen while processing messages. Errors receives them as well, but
+	// they are dropped if the channel isn't ready. If neither is set,
+	// errors are logged.
+	OnError func(*Error)
+	Errors  chan<- *Error
+
+	// MaxConcurrentCalls limits the number of async calls which are handled
+	// at the same time (16 by default, negative means no limit). Calls
+	// over the limit wait in a queue of CallQueueSize (64 by default,
+	// negative means no queue), and are rejected when it is full.
+	MaxConcurrentCalls int
+	CallQueueSize      int
+
+	// Stats makes the service expose statistics about its calls, values
+	// and connection in a "_stats" subcontract (if the root of its
+	// contract is a map), updated every StatsInterval (5 seconds by
+	// default). Calls which are rejected before reaching the handler
+	// (e.g. because of rate limits) are counted separately from the ones
+	// which are handled.
+	Stats         bool
+	StatsInterval time.Duration
+
+	// Logger receives the log messages of the connection (by default,
+	// warnings and errors go to the standard logger)
+	Logger logging.Logger
+
+	// Identity is sent along with our calls (it must not contain spaces
+	// or colons). If CallerSecret is set, our calls are signed with it,
+	// and only calls signed with it are considered verified. Signed calls
+	// are rejected if their timestamp is more than SignatureMaxAge (30
+	// seconds by default) away from our clock, or if they are replayed.
+	Identity        string
+	CallerSecret    []byte
+	SignatureMaxAge time.Duration
+
+	// Roles returns the roles of a caller, which are checked against the
+	// Roles of callables. Only verified callers get roles, unless
+	// TrustUnverifiedCallers is set, which is only safe if noone else can
+	// publish calls (e.g. thanks to the ACLs of the broker). Authorize is
+	// called before handling each call, and denies it by returning an
+	// error.
+	Roles                  func(identity string) []string
+	TrustUnverifiedCallers bool
+	Authorize              func(caller Caller, topic mqtt.Topic, callable *contracts.Callable) error
+
+	// Validation tells which values get type checked (all by default). It
+	// is overridden by StrictValidationEnv.
+	Validation ValidationPolicy
+
+	// ClientID is the MQTT client ID. If empty, the ID configured in the
+	// MQTT client (see mqtt.ClientIDProvider) is used. If that is empty
+	// too, the ID is derived from the service root and InstanceID (which
+	// defaults to the hostname), or made unique for connections which
+	// aren't services. Derived IDs are at most 23 bytes long.
+	ClientID   string
+	InstanceID string
+
+	// DedupWindow, if nonzero, is the time for which call tokens are
+	// remembered, so that calls which are delivered more than once
+	// (e.g. with QoS 1) are only handled once
+	DedupWindow time.Duration
+
+	// ContractVersion is published at the root of our contract (see
+	// contracts.Compatible for when the major version has to change).
+	// AcceptVersion is called for each remote contract, and the service
+	// is treated as gone (OnContract gets a nil contract) if it returns
+	// false, just like when its contract is invalid. Unversioned
+	// contracts have the zero version. AcceptVersion runs on the loop, so
+	// it must not make calls or otherwise wait for the connection.
+	ContractVersion contracts.Version
+	AcceptVersion   func(service mqtt.Topic, version contracts.Version) bool
+
+	// ProtocolVersion is the format of the calls we send. It defaults to
+	// ProtocolV1, because services written with the JavaScript library
+	// (js/qtrp-potoo) only understand version 1 calls; the default will
+	// switch to ProtocolV2 once that library accepts them. Calls are
+	// always accepted in both formats, and replied to in the format of
+	// the call.
+	ProtocolVersion int
 }
 
 type Connection struct {
-	opts ConnectionOptions
+	opts       ConnectionOptions
+	log        logging.Logger
+	validation ValidationPolicy
 
 	arena      *fastjson.Arena
 	arenaPool  *fastjson.ArenaPool
@@ -30,16 +137,82 @@ type Connection struct {
 	parserPool *fastjson.ParserPool
 	msgBuf     []byte
 
-	contractTopic mqtt.Topic
+	contract           contracts.Contract
+	contractTopic      mqtt.Topic
+	session            string
+	sessionTopic       mqtt.Topic
+	sessionSeen        bool
+	priorSessions      map[string]struct{} // seen before our own
+	newerCompetitor    bool
+	clientID           string
+	clientIDTopic      mqtt.Topic
+	uniqueClientID     bool
+	batchTopic         mqtt.Topic
+	watchingClientID   bool
+	checkingClientID   bool
+	everConnected      bool
+	ctx                context.Context
+	cancel             context.CancelFunc
+	publishedContracts [][]byte
+	watchingContract   bool
+	backingOff         bool
+	retakeTimer        <-chan time.Time
+	fatalErr           error
+
+	replyTopic  mqtt.Topic
+	replyFilter mqtt.Topic
 
 	mqttDisconnect chan error
 	mqttMessage    chan mqtt.Message
 	updateContract chan contracts.Contract
 	outgoingValues chan outgoingValue
 	asyncCalls     chan asyncCallResult
+	streamChunks   chan mqtt.Message
+	typeReports    chan *Error // never closed, since senders don't block
+	outgoingCalls  chan outgoingCall
+
+	shutdownRequests chan context.Context
+	shuttingDown     bool
+	shutdownCtx      context.Context
+	shutdownErr      error
+
+	callQueue          []queuedCall
+	runningCalls       int
+	runningPerCallable map[string]int // by call topic
+
+	stats *stats
+
+	callableBuckets map[string]*tokenBucket // by call topic
+	callerBuckets   map[callerBucketKey]*tokenBucket
+	seenTokens      map[string]struct{}
+	seenTokenQueue  []seenToken
+
+	seenSignatures     map[string]struct{}
+	seenSignatureQueue []seenToken
 
 	serviceCallableIndex map[string]*contracts.Callable
-	unsubscribers        []func()
+	serviceValueIndex    map[string]*serviceValue
+	staleValues          map[string]struct{} // removed, but not cleared yet
+
+	reconnectTimer    <-chan time.Time
+	reconnectDelay    time.Duration
+	reconnectAttempts int
+
+	remoteContracts   map[string]contracts.Contract
+	remoteCallables   map[string]remoteCallable
+	remoteValues      map[string]remoteValue
+	unverifiedValues  map[string][]byte
+	valueMirrors      map[string]*bus.JsonBus
+	persistentMirrors map[string]*bus.JsonBus
+	remoteMutex       sync.Mutex
+	deliveries        *deliveryQueue
+
+	pendingCalls map[string]pendingCall
+	pendingMutex sync.Mutex
+
+	clientSubs map[string]int
+	mqttUp     bool
+	subMutex   sync.Mutex
 
 	connected     bool
 	dead          bool
@@ -51,33 +224,80 @@ func New(opts *ConnectionOptions) *Connection {
 	c := &Connection{}
 
 	c.opts = *opts
+	c.log = opts.Logger
+	if c.log == nil {
+		c.log = logging.Std(nil, logging.LevelWarn)
+	}
+	c.validation = effectiveValidation(opts.Validation)
 	c.arena = &fastjson.Arena{}
 	c.arenaPool = &fastjson.ArenaPool{}
 	c.jsonparser = &fastjson.Parser{}
 	c.parserPool = &fastjson.ParserPool{}
 
 	c.contractTopic = c.serviceTopic(mqtt.Topic("_contract"))
+	c.batchTopic = c.serviceTopic(mqtt.Topic("_batch"))
+	c.session = randomString(16)
+	c.sessionTopic = c.serviceTopic(mqtt.Topic("_session"))
+	c.priorSessions = make(map[string]struct{})
+	c.clientID, c.uniqueClientID = c.makeClientID()
+	c.clientIDTopic = c.clientTopic(mqtt.Topic("_client"), mqtt.Topic(sanitizeClientID(c.clientID)))
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.replyTopic = mqtt.Topic(randomString(16))
+	c.replyFilter = mqtt.JoinTopics(mqtt.Topic("_reply"), c.replyTopic)
 
-	c.mqttDisconnect = make(chan error)
 	c.mqttMessage = make(chan mqtt.Message)
 	c.updateContract = make(chan contracts.Contract)
 	c.outgoingValues = make(chan outgoingValue)
 	c.asyncCalls = make(chan asyncCallResult)
+	c.streamChunks = make(chan mqtt.Message)
+	c.typeReports = make(chan *Error, typeReportBufferSize)
+	c.outgoingCalls = make(chan outgoingCall)
+	c.shutdownRequests = make(chan context.Context)
 
 	c.serviceCallableIndex = make(map[string]*contracts.Callable)
+	c.runningPerCallable = make(map[string]int)
+	c.callableBuckets = make(map[string]*tokenBucket)
+	c.callerBuckets = make(map[callerBucketKey]*tokenBucket)
+	c.seenTokens = make(map[string]struct{})
+	c.seenSignatures = make(map[string]struct{})
+	if opts.Stats {
+		c.stats = newStats()
+	}
+	c.serviceValueIndex = make(map[string]*serviceValue)
+	c.staleValues = make(map[string]struct{})
+	c.remoteContracts = make(map[string]contracts.Contract)
+	c.remoteCallables = make(map[string]remoteCallable)
+	c.remoteValues = make(map[string]remoteValue)
+	c.unverifiedValues = make(map[string][]byte)
+	c.valueMirrors = make(map[string]*bus.JsonBus)
+	c.persistentMirrors = make(map[string]*bus.JsonBus)
+	c.pendingCalls = make(map[string]pendingCall)
+	c.clientSubs = make(map[string]int)
+	c.clientSubscribe(c.replyFilter)
+	if c.opts.DiscoverServices || c.opts.OnContract != nil {
+		c.GetContracts(mqtt.Topic("#"))
+	}
 
 	c.thatsAllFolks = make(chan struct{})
 
 	return c
 }
 
-func (c *Connection) UpdateContract(contract contracts.Contract) {
+// UpdateContract replaces the contract of the service. It fails if some
+// of the keys can't be used in topics.
+func (c *Connection) UpdateContract(contract contracts.Contract) error {
+	err := contracts.Validate(contract)
+	if err != nil {
+		return fmt.Errorf("invalid contract: %s", err)
+	}
+
 	c.deathMutex.Lock()
 	defer c.deathMutex.Unlock()
 	if c.dead {
-		return
+		return nil
 	}
 	c.updateContract <- contract
+	return nil
 }
 
 func (c *Connection) Connect() error {
@@ -87,7 +307,24 @@ func (c *Connection) Connect() error {
 
 	c.connected = true
 
+	err := c.connectMqtt()
+	if err != nil {
+		c.deathMutex.Lock()
+		c.dead = true
+		c.deathMutex.Unlock()
+		return fmt.Errorf("Could not connect to MQTT: %s", err)
+	}
+
+	return nil
+}
+
+func (c *Connection) connectMqtt() error {
+	// buffered, so that the MQTT client can report errors while
+	// we're publishing
+	c.mqttDisconnect = make(chan error, 1)
+
 	connConfig := &mqtt.ConnectConfig{
+		ClientID:     c.clientID,
 		OnDisconnect: c.mqttDisconnect,
 		OnMessage:    c.mqttMessage,
 		WillMessage:  c.publishContractMessage(nil),
@@ -95,25 +332,39 @@ func (c *Connection) Connect() error {
 
 	err := c.opts.MqttClient.Connect(connConfig)
 	if err != nil {
-		c.dead = true
-		return fmt.Errorf("Could not connect to MQTT: %s", err)
+		return err
 	}
 
+	c.log.Info("connected to broker", logging.KeyService, string(c.serviceTopic(nil)), "client_id", c.clientID)
+	c.restoreClientSubscriptions()
+	c.announceClientID()
 	return nil
 }
 
 func (c *Connection) Loop(exit <-chan struct{}) error {
 	defer func() {
-		c.dead = true
+		// the channels are drained until thatsAllFolks is closed, so
+		// that whoever holds deathMutex while sending lets go of it
 		go c.closeUpdateContract()
 		go c.closeOutgoingValues()
 		go c.closeAsyncCalls()
+		go c.closeOutgoingCalls()
+		go c.closeStreamChunks()
+		go c.closeShutdownRequests()
 		c.deathMutex.Lock()
+		c.dead = true
 		close(c.thatsAllFolks)
 		c.deathMutex.Unlock()
 		c.destroyService()
+		c.deliveries.close()
+		c.cancel()
 	}()
 
+	c.deliveries = newDeliveryQueue()
+	if c.stats != nil {
+		go c.reportStats()
+	}
+
 	var err error
 	if c.dead {
 		return fmt.Errorf("Client has been unable to connect")
@@ -126,19 +377,33 @@ func (c *Connection) Loop(exit <-chan struct{}) error {
 		}
 	}
 
-	defer c.opts.MqttClient.DisconnectWithWill()
+	defer c.disconnect()
 
 	for {
 		select {
 		case err = <-c.mqttDisconnect:
-			if err != nil {
+			if err == nil {
+				return nil
+			}
+			if c.opts.Reconnect == nil {
 				return fmt.Errorf("MQTT error: %s", err)
 			}
-			return nil
+			c.log.Warn("lost connection to broker", logging.KeyError, err)
+			c.connectionLost()
+		case <-c.reconnectTimer:
+			err = c.reconnect()
+			if err != nil {
+				return err
+			}
 		case <-exit:
 			return nil
 		case msg := <-c.mqttMessage:
 			c.handleMsg(msg)
+			if c.fatalErr != nil {
+				return c.fatalErr
+			}
+		case <-c.retakeTimer:
+			c.stopBackingOff()
 		case contract := <-c.updateContract:
 			err = c.handleUpdateContract(contract)
 			if err != nil {
@@ -148,48 +413,72 @@ func (c *Connection) Loop(exit <-chan struct{}) error {
 		case ov := <-c.outgoingValues:
 			err = c.handleOutgoingValue(ov)
 			if err != nil {
-				return fmt.Errorf("Unable to send value: %s", err)
+				c.err(&Error{Category: TypeMismatch, Topic: ov.value.topic, Err: err})
 			}
 		case result := <-c.asyncCalls:
-			err = c.finaliseAsyncCall(result)
-			if err != nil {
-				return fmt.Errorf("Error during async call: %s", err)
-			}
+			c.finaliseAsyncCall(result)
+		case msg := <-c.streamChunks:
+			c.publish(msg)
+		case err := <-c.typeReports:
+			c.err(err)
+		case call := <-c.outgoingCalls:
+			c.handleOutgoingCall(call)
+		case ctx := <-c.shutdownRequests:
+			c.startShutdown(ctx)
+		case <-c.shutdownDeadline():
+			c.shutdownErr = c.shutdownCtx.Err()
+			c.log.Warn("calls didn't finish before shutdown",
+				"pending_calls", c.runningCalls+len(c.callQueue))
+			return nil
 		}
 		c.arena.Reset()
+
+		if c.drained() {
+			return nil
+		}
 	}
-	return nil
 }
 
 func (c *Connection) LoopOrDie() {
 	noExit := make(chan struct{})
 	err := c.Loop(noExit)
 	if err != nil {
-		log.Fatalf("Potoo loop failed: %s", err)
+		c.log.Error("potoo loop failed", logging.KeyError, err)
+		os.Exit(1)
 	}
-	log.Printf("Potoo loop finished.")
+	c.log.Info("potoo loop finished")
 	os.Exit(0)
 }
 
 func (c *Connection) handleOutgoingValue(ov outgoingValue) error {
-	err := types.TypeCheck(ov.v, ov.contract.Type)
+	if ov.value.removed {
+		// the value has been removed from the contract while being sent
+		ov.release()
+		return nil
+	}
+
+	err := c.typeCheck(c.validation.Values, ov.v, ov.value.contract.Type, ov.value.topic, "outgoing value")
 	if err != nil {
 		ov.release()
 		return fmt.Errorf("Outgoing value has wrong type: %s", err)
 	}
 
-	msg := c.msg(ov.topic, ov.v, true)
+	msg := c.msg(ov.value.topic, ov.value.contract.Encoding, ov.v, true)
 	ov.release() // now safe to release ov.v
 
+	if c.backingOff {
+		// values get republished when we stop backing off
+		return nil
+	}
 	c.publish(msg)
+	c.recordValuePublish(ov.value.topic)
 	return nil
 }
 
 type outgoingValue struct {
-	contract *contracts.Value
-	v        *fastjson.Value
-	topic    mqtt.Topic
-	sync     chan<- struct{}
+	value *serviceValue
+	v     *fastjson.Value
+	sync  chan<- struct{}
 }
 
 func (o *outgoingValue) release() {
@@ -199,76 +488,159 @@ func (o *outgoingValue) release() {
 	}
 }
 
+// handleUpdateContract only subscribes to (and unsubscribes from) the
+// callables and buses which have changed since the last update. Values
+// whose type has changed are checked and published again, and retained
+// values of removed buses are cleared.
 func (c *Connection) handleUpdateContract(contract contracts.Contract) error {
-	c.destroyService()
-	var err error
-	contracts.Traverse(contract, func(subcontr contracts.Contract, subtopic mqtt.Topic) {
-		if err != nil {
-			return
-		}
+	if c.stats != nil {
+		contract = c.mountStats(contract)
+	}
 
+	callables := make(map[string]*contracts.Callable)
+	values := make(map[string]contracts.Value)
+	contracts.Traverse(contract, func(subcontr contracts.Contract, subtopic mqtt.Topic) {
 		switch s := subcontr.(type) {
 		case contracts.Callable:
-			topic := c.serviceTopic(mqtt.Topic("_call"), subtopic)
-			c.serviceCallableIndex[string(topic)] = &s
-			c.opts.MqttClient.Subscribe(topic)
+			callables[string(c.serviceTopic(mqtt.Topic("_call"), subtopic))] = &s
 		case contracts.Value:
-			topic := c.serviceTopic(mqtt.Topic("_value"), subtopic)
-			sub := s.Bus.Subscribe(func(v *fastjson.Value) {
-				c.deathMutex.Lock()
-				if c.dead {
-					c.deathMutex.Unlock()
-					return
-				}
-				sync := make(chan struct{}) // TODO: can this be done with less channels?
-				c.outgoingValues <- outgoingValue{topic: topic, v: v, sync: sync, contract: &s}
-				c.deathMutex.Unlock()
-				<-sync
-			})
-			unsubscriber := func() {
-				s.Bus.Unsubscribe(sub)
-			}
-			c.unsubscribers = append(c.unsubscribers, unsubscriber)
-			defaultVal := s.Bus.Get(c.arena)
-			err = c.handleOutgoingValue(outgoingValue{contract: &s, topic: topic, v: defaultVal, sync: nil})
-			if err != nil {
-				return
-			}
+			values[string(c.serviceTopic(mqtt.Topic("_value"), subtopic))] = s
 		}
 	})
 
-	if err != nil {
-		return fmt.Errorf("Cannot update contract: %s", err)
+	for topic := range c.serviceCallableIndex {
+		if _, ok := callables[topic]; !ok {
+			c.unsubscribe(mqtt.Topic(topic))
+		}
+	}
+	for topic := range callables {
+		if _, ok := c.serviceCallableIndex[topic]; !ok {
+			c.subscribe(mqtt.Topic(topic))
+		}
+	}
+	if len(callables) > 0 && len(c.serviceCallableIndex) == 0 {
+		c.subscribe(c.batchTopic)
+	} else if len(callables) == 0 && len(c.serviceCallableIndex) > 0 {
+		c.unsubscribe(c.batchTopic)
+	}
+	old := c.serviceCallableIndex
+	c.serviceCallableIndex = callables
+	c.forgetBuckets(old)
+	c.startQueuedCalls() // the limits may have changed
+
+	for topic, sv := range c.serviceValueIndex {
+		s, ok := values[topic]
+		if ok && sameValueContract(s, sv.contract) {
+			continue
+		}
+		c.stopServingValue(sv)
+		if !ok {
+			c.clearValue(sv.topic)
+		}
+	}
+
+	c.contract = contract
+
+	for topic, s := range values {
+		if sv, ok := c.serviceValueIndex[topic]; ok {
+			sv.contract = s // the metadata may have changed
+			continue
+		}
+
+		sv := c.serveValue(mqtt.Topic(topic), s)
+		err := c.handleOutgoingValue(outgoingValue{value: sv, v: s.Bus.Get(c.arena)})
+		if err != nil {
+			return fmt.Errorf("Cannot update contract: %s", err)
+		}
 	}
 
-	c.publish(c.publishContractMessage(contract))
+	c.publishContract()
+	c.log.Debug("contract updated", logging.KeyService, string(c.serviceTopic(nil)))
 
 	return nil
 }
 
+type serviceValue struct {
+	contract    contracts.Value
+	topic       mqtt.Topic
+	unsubscribe func()
+	removed     bool
+}
+
+// sameValueContract tells if a bus can keep being served without
+// publishing its value again
+func sameValueContract(a contracts.Value, b contracts.Value) bool {
+	return a.Bus == b.Bus &&
+		types.Equivalent(a.Type, b.Type) &&
+		codec.Or(a.Encoding).Name() == codec.Or(b.Encoding).Name()
+}
+
+// clearValue clears the retained value of a removed bus. If we can't do
+// it now, it is done when the service is restored.
+func (c *Connection) clearValue(topic mqtt.Topic) {
+	if !c.online() || c.backingOff {
+		c.staleValues[string(topic)] = struct{}{}
+		return
+	}
+	c.publish(mqtt.Message{Topic: topic, Retain: true})
+}
+
+func (c *Connection) serveValue(topic mqtt.Topic, contract contracts.Value) *serviceValue {
+	sv := &serviceValue{contract: contract, topic: topic}
+	delete(c.staleValues, string(topic))
+
+	sub := contract.Bus.Subscribe(func(v *fastjson.Value) {
+		c.deathMutex.Lock()
+		if c.dead {
+			c.deathMutex.Unlock()
+			return
+		}
+		sync := make(chan struct{}) // TODO: can this be done with less channels?
+		c.outgoingValues <- outgoingValue{value: sv, v: v, sync: sync}
+		c.deathMutex.Unlock()
+		<-sync
+	})
+	sv.unsubscribe = func() {
+		contract.Bus.Unsubscribe(sub)
+	}
+
+	c.serviceValueIndex[string(topic)] = sv
+	return sv
+}
+
+func (c *Connection) stopServingValue(sv *serviceValue) {
+	delete(c.serviceValueIndex, string(sv.topic))
+	sv.removed = true
+
+	// the bus may be waiting for us to accept a value while holding
+	// its lock, so we can't unsubscribe synchronously
+	go sv.unsubscribe()
+}
+
 func (c *Connection) destroyService() {
-	for i := range c.unsubscribers {
-		c.unsubscribers[i]()
+	for _, sv := range c.serviceValueIndex {
+		sv.unsubscribe()
 	}
-	c.unsubscribers = nil
+	c.serviceValueIndex = make(map[string]*serviceValue)
 }
 
 func (c *Connection) publishContractMessage(contract contracts.Contract) mqtt.Message {
 	return c.msg(
 		c.contractTopic,
+		codec.JSON,
 		contracts.Encode(c.arena, contract),
 		true,
 	)
 }
 
-func (c *Connection) msg(topic mqtt.Topic, payload *fastjson.Value, retain bool, prefixes ...[]byte) mqtt.Message {
+func (c *Connection) msg(topic mqtt.Topic, enc codec.Codec, payload *fastjson.Value, retain bool, prefixes ...[]byte) mqtt.Message {
 	c.msgBuf = c.msgBuf[0:0]
 	for _, pref := range prefixes {
 		c.msgBuf = append(c.msgBuf, pref...)
 		c.msgBuf = append(c.msgBuf, ' ')
 	}
 
-	c.msgBuf = payload.MarshalTo(c.msgBuf)
+	c.msgBuf = codec.Or(enc).Marshal(c.msgBuf, payload)
 	return mqtt.Message{
 		Topic:   topic,
 		Payload: c.msgBuf,
@@ -276,127 +648,271 @@ func (c *Connection) msg(topic mqtt.Topic, payload *fastjson.Value, retain bool,
 	}
 }
 
-// TODO: async calls (some way for the handler to return a channel which will be read later?)
-func (c *Connection) handleCall(msg mqtt.Message, callable *contracts.Callable) error {
-	if callable.Async == false {
-		return c.finaliseCall(handleCallHelper(c.arena, c.jsonparser, msg, callable))
-	} else {
-		go func() {
-			arena := c.arenaPool.Get()
-			parser := c.parserPool.Get()
-			result := handleCallHelper(arena, parser, msg, callable)
-
-			c.deathMutex.Lock()
-			defer c.deathMutex.Unlock()
-			if c.dead {
-				// the potoo service died while handling the call, there
-				// is noone to return the result to
-				return
-			}
+func (c *Connection) handleCall(msg mqtt.Message, callable *contracts.Callable) {
+	if c.duplicateCall(msg) {
+		return
+	}
 
-			c.asyncCalls <- asyncCallResult{
-				callResult: result,
-				arena:      arena,
-				parser:     parser,
-			}
-		}()
+	caller, perr := c.authorizeCall(msg, callable)
+	if perr != nil {
+		c.rejectCall(msg, perr)
+		return
+	}
+
+	if c.rateLimited(msg, callable, caller) {
+		c.rejectCall(msg, newError(RateLimited, msg.Topic, "too many calls"))
+		return
+	}
+
+	if callable.Async == false && !callable.IsStream() {
+		started := time.Now()
+		result := c.handleCallHelper(c.arena, c.jsonparser, msg, callable, caller)
+		c.callDone(msg.Topic, started, result)
+		c.finaliseCall(result)
+	} else {
+		c.handleAsyncCall(queuedCall{msg: *msg.Copy(), callable: callable, caller: caller})
 	}
-	return nil
 }
 
-func (c *Connection) finaliseAsyncCall(result asyncCallResult) error {
+func (c *Connection) finaliseAsyncCall(result asyncCallResult) {
 	defer c.parserPool.Put(result.parser)
 	defer c.arenaPool.Put(result.arena)
 	defer result.arena.Reset() // TODO: see if we really need this
 
-	return c.finaliseCall(result.callResult)
+	c.callDone(result.callTopic, result.started, result.callResult)
+	if result.batch != nil {
+		c.finaliseBatchItem(result.batch, result.index, result.callResult)
+	} else {
+		c.finaliseCall(result.callResult)
+	}
+	c.asyncCallDone(result.callTopic)
 }
 
-func (c *Connection) finaliseCall(result callResult) error {
+func (c *Connection) finaliseCall(result callResult) {
 	if result.err != nil {
-		return result.err
+		c.err(result.err)
+		if result.topic != nil {
+			c.publish(c.reply(result, "error", encodeCallError(c.arena, result.err)))
+		}
+		return
+	}
+	if result.end {
+		if result.topic != nil {
+			c.publish(c.reply(result, "end", nil))
+		}
+		return
 	}
 	if result.payload == nil {
 		// void call
-		return nil
+		return
 	}
-	c.publish(c.msg(result.topic, result.payload, false, result.token))
-	return nil
+	c.publish(c.reply(result, "result", result.payload))
+}
+
+// reply builds a reply message. Errors are always in JSON.
+func (c *Connection) reply(result callResult, kind string, v *fastjson.Value) mqtt.Message {
+	enc := codec.Or(result.encoding)
+	if kind == "error" {
+		enc = codec.JSON
+	}
+	c.msgBuf = appendReplyHead(c.msgBuf[0:0], result.version, result.token, kind, enc)
+	if v != nil {
+		c.msgBuf = enc.Marshal(c.msgBuf, v)
+	}
+	c.msgBuf = appendReplyTail(c.msgBuf, result.version)
+	return mqtt.Message{Topic: result.topic, Payload: c.msgBuf}
 }
 
 type asyncCallResult struct {
 	callResult
 
-	arena  *fastjson.Arena
-	parser *fastjson.Parser
+	callTopic mqtt.Topic
+	started   time.Time
+	batch     *pendingBatch
+	index     int
+	arena     *fastjson.Arena
+	parser    *fastjson.Parser
 }
 
 type callResult struct {
-	err     error
-	topic   mqtt.Topic
-	token   []byte
-	payload *fastjson.Value
+	end      bool // the end of a stream
+	err      *Error
+	topic    mqtt.Topic
+	token    []byte
+	version  int         // of the call message
+	encoding codec.Codec // of the payload
+	payload  *fastjson.Value
+}
+
+// callDone logs a handled call and records it in the statistics
+func (c *Connection) callDone(topic mqtt.Topic, started time.Time, result callResult) {
+	latency := time.Since(started)
+	if result.err != nil {
+		c.log.Debug("call failed", logging.KeyTopic, string(topic), logging.KeyToken, string(result.token),
+			logging.KeyLatency, latency, logging.KeyError, result.err.Err)
+	} else {
+		c.log.Debug("call handled", logging.KeyTopic, string(topic), logging.KeyToken, string(result.token),
+			logging.KeyLatency, latency)
+	}
+	c.recordCall(topic, started, result.err != nil)
 }
 
-func handleCallHelper(arena *fastjson.Arena, parser *fastjson.Parser, msg mqtt.Message, callable *contracts.Callable) callResult {
-	var topic []byte
-	var token []byte
-	var argumentData []byte
+// callContext returns the context for a CtxHandler or StreamHandler
+func (c *Connection) callContext(msg mqtt.Message, result callResult, callable *contracts.Callable, caller Caller) (context.Context, context.CancelFunc) {
+	path, _ := mqtt.StripTopic(c.serviceTopic(mqtt.Topic("_call")), msg.Topic)
+	ctx := bus.WithCallInfo(c.ctx, &bus.CallInfo{
+		Topic:          msg.Topic,
+		Path:           path,
+		ReplyTopic:     result.topic,
+		Token:          string(result.token),
+		Caller:         caller.ID,
+		CallerVerified: caller.Verified,
+	})
+	if callable.Timeout != 0 {
+		return context.WithTimeout(ctx, callable.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (c *Connection) handleCallHelper(arena *fastjson.Arena, parser *fastjson.Parser, msg mqtt.Message, callable *contracts.Callable, caller Caller) (result callResult) {
+	h := parseCallMessage(msg.Payload)
+	argumentData := h.argument
+
+	if len(h.replyTopic) != 0 {
+		result.topic = mqtt.JoinTopics(mqtt.Topic("_reply"), mqtt.Topic(h.replyTopic))
+		result.token = append([]byte(nil), h.token...)
+		result.version = h.version
+	}
+	fail := func(category ErrorCategory, format string, args ...interface{}) callResult {
+		result.err = newError(category, msg.Topic, format, args...)
+		result.payload = nil
+		return result
+	}
 
-	limitedSplit(msg.Payload, ' ', &topic, &token, &argumentData)
+	defer func() {
+		if r := recover(); r != nil {
+			result = fail(HandlerFailure, "handler panicked: %v", r)
+		}
+	}()
 
-	argument, err := parser.ParseBytes(argumentData)
+	// values embedded in JSON objects are always JSON
+	result.encoding = callable.Encoding
+	if h.version >= ProtocolV2 {
+		result.encoding = nil
+	}
+	argument, err := codec.Or(result.encoding).Unmarshal(parser, arena, argumentData)
 	if err != nil {
-		return callResult{err: fmt.Errorf("unable to parse argument data: %s", err)}
+		return fail(BadArgument, "unable to parse argument data: %s", err)
 	}
 
-	// TODO: skip this in insane mode
-	err = types.TypeCheck(argument, callable.Argument)
+	err = c.typeCheck(c.validation.Arguments, argument, callable.Argument, msg.Topic, "argument")
 	if err != nil {
-		return callResult{err: fmt.Errorf("argument has wrong type: %s", err)}
+		return fail(TypeMismatch, "argument has wrong type: %w", err)
+	}
+
+	var retval *fastjson.Value
+	switch {
+	case callable.StreamHandler != nil:
+		ctx, cancel := c.callContext(msg, result, callable, caller)
+		defer cancel()
+		err = callable.StreamHandler(ctx, arena, argument, c.streamEmitter(msg, result, callable))
+	case callable.CtxHandler != nil:
+		ctx, cancel := c.callContext(msg, result, callable, caller)
+		defer cancel()
+		retval, err = callable.CtxHandler(ctx, arena, argument)
+	case callable.ErrHandler != nil:
+		retval, err = callable.ErrHandler(arena, argument)
+	default:
+		retval = callable.Handler(arena, argument)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fail(DeadlineExceeded, "%w", err)
+	}
+	var perr *Error
+	if errors.As(err, &perr) {
+		result.err = perr
+		return result
+	}
+	if err != nil {
+		return fail(HandlerFailure, "%w", err)
+	}
+
+	if callable.IsStream() {
+		result.end = true
+		return result
 	}
 
-	retval := callable.Handler(arena, argument)
 	switch callable.Retval.T.(type) {
 	case *types.TVoid:
 		if retval != nil {
-			return callResult{err: fmt.Errorf("Void-typed handler returned non-nil")}
+			return fail(HandlerFailure, "Void-typed handler returned non-nil")
 		}
 		return callResult{}
 	}
 
 	if retval == nil {
-		return callResult{err: fmt.Errorf("non-void call handler returned nil!")}
+		return fail(HandlerFailure, "non-void call handler returned nil!")
 	}
 
-	// TODO: skip this in unsafe mode
-	err = types.TypeCheck(retval, callable.Retval)
+	err = c.typeCheck(c.validation.Results, retval, callable.Retval, msg.Topic, "returned value")
 	if err != nil {
-		return callResult{err: fmt.Errorf("Handler returned value of wrong type: %s", err)}
+		return fail(TypeMismatch, "Handler returned value of wrong type: %w", err)
 	}
 
-	return callResult{
-		topic:   mqtt.JoinTopics(mqtt.Topic("_reply"), mqtt.Topic(topic)),
-		token:   append([]byte(nil), token...),
-		payload: retval,
-	}
+	result.payload = retval
+	return result
 }
 
 func (c *Connection) handleMsg(msg mqtt.Message) {
 	if callable, ok := c.serviceCallableIndex[string(msg.Topic)]; ok {
-		err := c.handleCall(msg, callable)
-		if err != nil {
-			c.err(fmt.Errorf("error while processing call on '%s': %s", string(msg.Topic), err))
+		if c.shuttingDown {
+			c.rejectCall(msg, newError(ShuttingDown, msg.Topic, "service is shutting down"))
+			return
 		}
+		c.handleCall(msg, callable)
 		return
 	}
 
-	c.err(fmt.Errorf("don't know what to do with message on '%s'", string(msg.Topic)))
-}
+	if string(msg.Topic) == string(c.batchTopic) && len(c.serviceCallableIndex) > 0 {
+		if c.shuttingDown {
+			c.rejectCall(msg, newError(ShuttingDown, msg.Topic, "service is shutting down"))
+			return
+		}
+		c.handleBatch(msg)
+		return
+	}
+
+	if string(msg.Topic) == string(c.clientIDTopic) {
+		c.handleClientIDAnnouncement(msg.Payload)
+		return
+	}
+
+	if string(msg.Topic) == string(c.sessionTopic) {
+		c.handleSessionAnnouncement(msg.Payload)
+		return
+	}
 
-func (c *Connection) err(err error) {
-	// gracefully handle this here
-	panic(err)
+	if string(msg.Topic) == string(c.contractTopic) {
+		c.handleOwnContract(msg.Payload)
+		// we may be discovering ourselves as well
+	}
+
+	if string(msg.Topic) == string(c.replyFilter) {
+		c.handleReply(msg)
+		return
+	}
+
+	if service, ok := mqtt.StripTopic(c.clientTopic(mqtt.Topic("_contract")), msg.Topic); ok {
+		c.handleRemoteContract(service, msg.Payload)
+		return
+	}
+
+	if _, ok := mqtt.StripTopic(c.clientTopic(mqtt.Topic("_value")), msg.Topic); ok {
+		c.handleRemoteValue(msg)
+		return
+	}
+
+	c.err(newError(UnknownTopic, msg.Topic, "don't know what to do with this message"))
 }
 
 func (c *Connection) serviceTopic(prefix mqtt.Topic, suffixes ...mqtt.Topic) mqtt.Topic {
@@ -414,14 +930,34 @@ func (c *Connection) clientTopic(prefix mqtt.Topic, suffixes ...mqtt.Topic) mqtt
 }
 
 func (c *Connection) publish(msg mqtt.Message) {
+	if !c.online() {
+		// values and the contract get republished after reconnecting
+		return
+	}
 	c.opts.MqttClient.Publish(msg)
 }
 
+func (c *Connection) subscribe(filter mqtt.Topic) {
+	if !c.online() || c.backingOff || c.shuttingDown {
+		// service topics get resubscribed after reconnecting
+		// or when we stop backing off
+		return
+	}
+	c.opts.MqttClient.Subscribe(filter)
+}
+
+func (c *Connection) unsubscribe(filter mqtt.Topic) {
+	if !c.online() {
+		return
+	}
+	c.opts.MqttClient.Unsubscribe(filter)
+}
+
 func limitedSplit(x []byte, sep byte, into ...(*[]byte)) {
 	for i := 0; i < len(into); i++ {
 		idx := -1
 		for j := 0; j < len(x); j++ {
-			if x[j] == ' ' {
+			if x[j] == sep {
 				idx = j
 				break
 			}
@@ -436,7 +972,7 @@ func limitedSplit(x []byte, sep byte, into ...(*[]byte)) {
 	}
 }
 
-// these three functions are three and not one because go is stupid
+// these functions are many and not one because go is stupid
 // and has no generics
 
 func (c *Connection) closeUpdateContract() {
@@ -450,8 +986,6 @@ func (c *Connection) closeUpdateContract() {
 			// discard message to unblock the caller
 		case _ = <-c.thatsAllFolks:
 			return
-		default:
-			return
 		}
 	}
 }
@@ -467,8 +1001,6 @@ func (c *Connection) closeOutgoingValues() {
 			close(ov.sync)
 		case _ = <-c.thatsAllFolks:
 			return
-		default:
-			return
 		}
 	}
 }
@@ -484,7 +1016,35 @@ func (c *Connection) closeAsyncCalls() {
 			// discard message to unblock the caller
 		case _ = <-c.thatsAllFolks:
 			return
-		default:
+		}
+	}
+}
+
+func (c *Connection) closeStreamChunks() {
+	ch := c.streamChunks
+
+	defer close(ch)
+
+	for {
+		select {
+		case _ = <-ch:
+			// discard message to unblock the caller
+		case _ = <-c.thatsAllFolks:
+			return
+		}
+	}
+}
+
+func (c *Connection) closeOutgoingCalls() {
+	ch := c.outgoingCalls
+
+	defer close(ch)
+
+	for {
+		select {
+		case call := <-ch:
+			call.accepted <- callAcceptance{err: errConnectionDead}
+		case _ = <-c.thatsAllFolks:
 			return
 		}
 	}
@@ -0,0 +1,116 @@
+package potoo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/logging"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+)
+
+// ReconnectPolicy describes how a connection recovers from losing the
+// broker. The delay between attempts starts at MinDelay and doubles after
+// each failed attempt, up to MaxDelay. After reconnecting, the connection
+// restores its subscriptions and republishes its contract and values.
+type ReconnectPolicy struct {
+	MinDelay    time.Duration // defaults to 1 second
+	MaxDelay    time.Duration // defaults to 1 minute
+	MaxAttempts int           // 0 means retrying forever
+}
+
+func (p *ReconnectPolicy) minDelay() time.Duration {
+	if p.MinDelay == 0 {
+		return 1 * time.Second
+	}
+	return p.MinDelay
+}
+
+func (p *ReconnectPolicy) maxDelay() time.Duration {
+	if p.MaxDelay == 0 {
+		return 1 * time.Minute
+	}
+	return p.MaxDelay
+}
+
+func (c *Connection) connectionLost() {
+	c.goOffline()
+
+	// the old channel gets closed by the MQTT client
+	c.mqttDisconnect = nil
+
+	c.reconnectAttempts = 0
+	c.reconnectDelay = c.opts.Reconnect.minDelay()
+	c.reconnectTimer = time.After(c.reconnectDelay)
+}
+
+func (c *Connection) reconnect() error {
+	c.reconnectTimer = nil
+	c.reconnectAttempts++
+
+	err := c.connectMqtt()
+	if err != nil {
+		policy := c.opts.Reconnect
+		c.log.Info("unable to reconnect to broker", logging.KeyAttempt, c.reconnectAttempts, logging.KeyError, err)
+		if policy.MaxAttempts != 0 && c.reconnectAttempts >= policy.MaxAttempts {
+			return fmt.Errorf("Unable to reconnect to MQTT after %d attempts: %s", c.reconnectAttempts, err)
+		}
+
+		c.reconnectDelay *= 2
+		if c.reconnectDelay > policy.maxDelay() {
+			c.reconnectDelay = policy.maxDelay()
+		}
+		c.reconnectTimer = time.After(c.reconnectDelay)
+		return nil
+	}
+
+	c.recordReconnect()
+	return c.restoreService()
+}
+
+// restoreService resubscribes to all call topics, republishes the
+// contract and the current values of all buses, and clears the values
+// which have been removed in the meantime
+func (c *Connection) restoreService() error {
+	if c.backingOff {
+		// the service will be restored when we stop backing off
+		return nil
+	}
+
+	for _, topic := range c.callTopics() {
+		c.subscribe(topic)
+	}
+
+	for topic := range c.staleValues {
+		c.publish(mqtt.Message{Topic: mqtt.Topic(topic), Retain: true})
+		delete(c.staleValues, topic)
+	}
+
+	if c.contract == nil {
+		return nil
+	}
+
+	for _, sv := range c.serviceValueIndex {
+		err := c.handleOutgoingValue(outgoingValue{value: sv, v: sv.contract.Bus.Get(c.arena)})
+		if err != nil {
+			return fmt.Errorf("Unable to republish values: %s", err)
+		}
+	}
+
+	c.publishContract()
+	return nil
+}
+
+func (c *Connection) disconnect() {
+	if c.shuttingDown {
+		c.clearClientID()
+	}
+	if !c.goOffline() {
+		return
+	}
+	if c.fatalErr == ErrCompetingService || c.fatalErr == ErrClientIDCollision {
+		// the will would clear the competitor's contract
+		c.opts.MqttClient.Disconnect()
+		return
+	}
+	c.opts.MqttClient.DisconnectWithWill()
+}
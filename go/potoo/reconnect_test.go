@@ -0,0 +1,81 @@
+package potoo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/bus"
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+func TestReconnect(t *testing.T) {
+	b := newFakeBroker()
+	temp := bus.NewIntBus(1)
+	svc, mqttClient := startConnection(t, b, ConnectionOptions{
+		ServiceRoot: mqtt.Topic("svc"),
+		Reconnect:   &ReconnectPolicy{MinDelay: 10 * time.Millisecond},
+	})
+	svc.UpdateContract(contracts.Map{
+		"temp": contracts.Value{Type: types.Int(), Bus: temp},
+		"double": contracts.Callable{
+			Argument: types.Int(),
+			Retval:   types.Int(),
+			Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+				return a.NewNumberInt(arg.GetInt() * 2)
+			},
+		},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	mqttClient.drop()
+	contract, _ := b.retainedValue("_contract/things/svc")
+	if string(contract) != "null" {
+		t.Errorf("the will didn't clear the contract, which is %s", contract)
+	}
+
+	eventually(t, "the service republishes its contract", func() bool {
+		contract, _ := b.retainedValue("_contract/things/svc")
+		return string(contract) != "null"
+	})
+	eventually(t, "calls work again", func() bool {
+		r, err := cl.Call(context.Background(), mqtt.Topic("svc/double"), q.Int(21))
+		return err == nil && r.GetInt() == 42
+	})
+
+	b.publish(mqtt.Message{Topic: mqtt.Topic("_value/things/svc/temp"), Retain: true})
+	mqttClient.drop()
+	eventually(t, "the service republishes its values", func() bool {
+		value, _ := b.retainedValue("_value/things/svc/temp")
+		return string(value) == "1"
+	})
+}
+
+func TestRemoveValueOffline(t *testing.T) {
+	b := newFakeBroker()
+	svc, mqttClient := startConnection(t, b, ConnectionOptions{
+		ServiceRoot: mqtt.Topic("svc"),
+		Reconnect:   &ReconnectPolicy{MinDelay: 300 * time.Millisecond},
+	})
+	svc.UpdateContract(contracts.Map{
+		"temp": contracts.Value{Type: types.Int(), Bus: bus.NewIntBus(1)},
+	})
+	eventually(t, "the service publishes the value", func() bool {
+		value, _ := b.retainedValue("_value/things/svc/temp")
+		return string(value) == "1"
+	})
+
+	mqttClient.drop()
+	eventually(t, "the service notices the disconnect", func() bool {
+		return !svc.online()
+	})
+	svc.UpdateContract(contracts.Map{})
+	eventually(t, "the removed value is cleared after reconnecting", func() bool {
+		_, ok := b.retainedValue("_value/things/svc/temp")
+		return !ok
+	})
+}
@@ -0,0 +1,153 @@
+package potoo
+
+import (
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/valyala/fastjson"
+)
+
+// Services returns a snapshot of the contracts of all known services, keyed
+// by service root. Services are known if their contract topics are covered
+// by DiscoverServices or GetContracts.
+func (c *Connection) Services() map[string]contracts.Contract {
+	c.remoteMutex.Lock()
+	defer c.remoteMutex.Unlock()
+
+	services := make(map[string]contracts.Contract, len(c.remoteContracts))
+	for service, contract := range c.remoteContracts {
+		services[service] = contract
+	}
+	return services
+}
+
+// Service returns the contract of the service at the given service root,
+// if it is known.
+func (c *Connection) Service(service mqtt.Topic) (contracts.Contract, bool) {
+	c.remoteMutex.Lock()
+	defer c.remoteMutex.Unlock()
+
+	contract, ok := c.remoteContracts[string(mqtt.JoinTopics(service))]
+	return contract, ok
+}
+
+func (c *Connection) handleRemoteContract(service mqtt.Topic, payload []byte) {
+	// a service whose contract we can't use counts as gone
+	contract, err := c.decodeRemoteContract(service, payload)
+	if err != nil {
+		c.err(err)
+	}
+
+	c.remoteMutex.Lock()
+	defer c.remoteMutex.Unlock()
+
+	// values which stay the same keep their persistent mirrors quiet
+	old := c.forgetRemoteContract(service)
+
+	if contract != nil {
+		c.remoteContracts[string(service)] = contract
+	}
+
+	contracts.Traverse(contract, func(subcontr contracts.Contract, subtopic mqtt.Topic) {
+		topic := mqtt.JoinTopics(service, subtopic)
+		valueTopic := string(c.clientTopic(mqtt.Topic("_value"), topic))
+
+		var rv remoteValue
+		switch s := subcontr.(type) {
+		case contracts.Callable:
+			c.remoteCallables[string(topic)] = remoteCallable{service: string(service), callable: s}
+			return
+		case contracts.Value:
+			rv = remoteValue{service: string(service), typ: s.Type, encoding: s.Encoding}
+		case contracts.Constant:
+			rv = remoteValue{service: string(service), constant: s.Value}
+		default:
+			return
+		}
+
+		c.remoteValues[valueTopic] = rv
+		oldValue, existed := old[valueTopic]
+		delete(old, valueTopic)
+		if existed && sameRemoteValue(oldValue, rv) {
+			return
+		}
+		if existed && (oldValue.constant == nil || rv.constant == nil) {
+			c.notifyPersistent(valueTopic, "offline", nil)
+		}
+
+		if rv.constant != nil {
+			c.notifyPersistent(valueTopic, "constant", rv.constant)
+			return
+		}
+		c.notifyPersistent(valueTopic, "online", nil)
+		if data, ok := c.unverifiedValues[valueTopic]; ok {
+			delete(c.unverifiedValues, valueTopic)
+			c.mirrorValue(valueTopic, rv.typ, rv.encoding, data)
+		}
+	})
+
+	for valueTopic := range old {
+		c.notifyPersistent(valueTopic, "offline", nil)
+	}
+
+	if c.opts.OnContract != nil {
+		service = append(mqtt.Topic(nil), service...)
+		c.deliveries.push(func() {
+			c.opts.OnContract(service, contract)
+		})
+	}
+}
+
+// decodeRemoteContract decodes a contract and checks if its version is
+// accepted. It is called on the loop without holding remoteMutex, so
+// AcceptVersion may look at the known services (e.g. with Services), but
+// must not call back into the connection (e.g. with Call), which would
+// wait for the loop forever.
+func (c *Connection) decodeRemoteContract(service mqtt.Topic, payload []byte) (contracts.Contract, *Error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+
+	// each contract gets its own parser, since the decoded contract
+	// references the parsed value
+	v, err := fastjson.ParseBytes(payload)
+	if err != nil {
+		return nil, newError(BadContract, service, "unable to parse contract: %s", err)
+	}
+	contract, err := contracts.Decode(v)
+	if err != nil {
+		return nil, newError(BadContract, service, "unable to decode contract: %s", err)
+	}
+	err = contracts.Validate(contract)
+	if err != nil {
+		return nil, newError(BadContract, service, "invalid contract: %s", err)
+	}
+	version, err := contracts.VersionOf(contract)
+	if err != nil {
+		return nil, newError(BadContract, service, "%s", err)
+	}
+	if c.opts.AcceptVersion != nil && !c.opts.AcceptVersion(service, version) {
+		return nil, newError(IncompatibleVersion, service, "contract version %s is not accepted", version)
+	}
+	return contract, nil
+}
+
+// forgetRemoteContract forgets the contract of a service, and returns
+// its values (keyed by value topic), which the caller has to notify as
+// offline unless the new contract has them too
+func (c *Connection) forgetRemoteContract(service mqtt.Topic) map[string]remoteValue {
+	delete(c.remoteContracts, string(service))
+
+	for topic, rc := range c.remoteCallables {
+		if rc.service == string(service) {
+			delete(c.remoteCallables, topic)
+		}
+	}
+	values := make(map[string]remoteValue)
+	for topic, rv := range c.remoteValues {
+		if rv.service == string(service) {
+			delete(c.remoteValues, topic)
+			values[topic] = rv
+		}
+	}
+	return values
+}
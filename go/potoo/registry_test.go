@@ -0,0 +1,155 @@
+package potoo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+type contractEvent struct {
+	service  string
+	contract contracts.Contract
+}
+
+func expectContractEvent(t *testing.T, events <-chan contractEvent, service string, present bool) {
+	t.Helper()
+
+	select {
+	case e := <-events:
+		if e.service != service || (e.contract != nil) != present {
+			t.Errorf("got contract %v of %s instead of a contract of %s (present: %v)",
+				e.contract, e.service, service, present)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("timed out waiting for the contract of %s", service)
+	}
+}
+
+func TestServices(t *testing.T) {
+	b := newFakeBroker()
+	svc, _ := b.peer()
+	svc.publishContract(contracts.Map{"name": q.StringConst("svc")})
+
+	events := make(chan contractEvent, 16)
+	cl, _ := startConnection(t, b, ConnectionOptions{
+		OnContract: func(service mqtt.Topic, contract contracts.Contract) {
+			events <- contractEvent{service: string(service), contract: contract}
+		},
+	})
+	expectContractEvent(t, events, "svc", true)
+
+	svc.publishContractAt("other", contracts.Map{"name": q.StringConst("other")})
+	expectContractEvent(t, events, "other", true)
+
+	services := cl.Services()
+	if len(services) != 2 || services["svc"] == nil || services["other"] == nil {
+		t.Errorf("known services are %v", services)
+	}
+	contract, ok := cl.Service(mqtt.Topic("other"))
+	m, _ := contract.(contracts.Map)
+	name, _ := m["name"].(contracts.Constant)
+	if !ok || name.Value == nil || string(name.Value.GetStringBytes()) != "other" {
+		t.Errorf("contract of other is %v", contract)
+	}
+
+	svc.Publish(mqtt.Message{Topic: mqtt.Topic("_contract/things/other"), Payload: []byte("null"), Retain: true})
+	expectContractEvent(t, events, "other", false)
+	if _, ok := cl.Service(mqtt.Topic("other")); ok {
+		t.Errorf("service which has gone away is still known")
+	}
+}
+
+func TestAcceptVersion(t *testing.T) {
+	b := newFakeBroker()
+	svc, _ := b.peer()
+	svc.publishContract(contracts.WithVersion(contracts.Map{"name": q.StringConst("svc")}, contracts.MustParseVersion("1.2.0")))
+
+	events := make(chan contractEvent, 16)
+	conn := make(chan *Connection, 1)
+	known := make(chan int, 16)
+	cl, _ := startConnection(t, b, ConnectionOptions{
+		OnContract: func(service mqtt.Topic, contract contracts.Contract) {
+			events <- contractEvent{service: string(service), contract: contract}
+		},
+		AcceptVersion: func(service mqtt.Topic, version contracts.Version) bool {
+			// the known services may be looked at from here
+			cl := <-conn
+			conn <- cl
+			known <- len(cl.Services())
+			return version.Major == 1
+		},
+	})
+	conn <- cl
+	expectContractEvent(t, events, "svc", true)
+	<-known
+
+	// a contract which isn't accepted replaces the old one
+	svc.publishContract(contracts.WithVersion(contracts.Map{"name": q.StringConst("svc")}, contracts.MustParseVersion("2.0.0")))
+	expectContractEvent(t, events, "svc", false)
+	if n := <-known; n != 1 {
+		t.Errorf("AcceptVersion saw %d services", n)
+	}
+	if _, ok := cl.Service(mqtt.Topic("svc")); ok {
+		t.Errorf("service with an incompatible contract is still known")
+	}
+
+	svc.publishContract(contracts.Map{"name": contracts.Map{"_t": q.StringConst("nope")}})
+	expectContractEvent(t, events, "svc", false)
+
+	svc.publishContract(contracts.WithVersion(contracts.Map{"name": q.StringConst("svc")}, contracts.MustParseVersion("1.3.0")))
+	expectContractEvent(t, events, "svc", true)
+}
+
+func TestBadConstraints(t *testing.T) {
+	b := newFakeBroker()
+	bad := contracts.Map{"level": contracts.Value{
+		Type: types.Int().M(types.MetaData{
+			types.MetaMin: fastjson.MustParse(`20`),
+			types.MetaMax: fastjson.MustParse(`0`),
+		}),
+	}}
+
+	svc := startService(t, b, ConnectionOptions{}, contracts.Map{})
+	if err := svc.UpdateContract(bad); err == nil {
+		t.Errorf("contract with a minimum above its maximum was accepted")
+	}
+
+	peer, _ := b.peer()
+	peer.publishContractAt("other", bad)
+	errs := make(chan *Error, 16)
+	events := make(chan contractEvent, 16)
+	startConnection(t, b, ConnectionOptions{
+		Errors: errs,
+		OnContract: func(service mqtt.Topic, contract contracts.Contract) {
+			if string(service) == "other" {
+				events <- contractEvent{service: string(service), contract: contract}
+			}
+		},
+	})
+	expectError(t, errs, BadContract, "other")
+	expectContractEvent(t, events, "other", false)
+}
+
+func TestContractKeys(t *testing.T) {
+	b := newFakeBroker()
+	svc := startService(t, b, ConnectionOptions{}, contracts.Map{})
+
+	err := svc.UpdateContract(contracts.Map{"lamp/1": contracts.Map{"on": q.StringConst("yes")}})
+	if err == nil {
+		t.Errorf("contract with a '/' in a key was accepted")
+	}
+
+	svc.UpdateContract(contracts.Map{mqtt.EscapeKey("lamp/1"): contracts.Map{"on": q.StringConst("yes")}})
+	cl := startClient(t, b, ConnectionOptions{})
+	eventually(t, "the client knows the escaped key", func() bool {
+		contract, _ := cl.Service(mqtt.Topic("svc"))
+		m, _ := contract.(contracts.Map)
+		_, ok := m["lamp%2F1"]
+		return ok
+	})
+}
@@ -0,0 +1,82 @@
+package potoo
+
+import (
+	"context"
+
+	"github.com/dexterlb/potoo/go/potoo/logging"
+)
+
+// Shutdown stops the service gracefully: it stops accepting calls, waits
+// for the calls which are being handled until ctx is done, sends their
+// replies along with any pending values, and then makes Loop return,
+// which publishes the null contract and disconnects. It returns ctx.Err()
+// if the calls didn't finish in time.
+func (c *Connection) Shutdown(ctx context.Context) error {
+	c.deathMutex.Lock()
+	if c.dead {
+		c.deathMutex.Unlock()
+		return errConnectionDead
+	}
+	c.shutdownRequests <- ctx
+	c.deathMutex.Unlock()
+
+	<-c.thatsAllFolks
+	return c.shutdownErr
+}
+
+func (c *Connection) startShutdown(ctx context.Context) {
+	if c.shuttingDown {
+		return
+	}
+	c.shuttingDown = true
+	c.shutdownCtx = ctx
+
+	for _, topic := range c.callTopics() {
+		c.unsubscribe(topic)
+	}
+	c.log.Info("shutting down", logging.KeyService, string(c.serviceTopic(nil)),
+		"pending_calls", c.runningCalls+len(c.callQueue))
+}
+
+// shutdownDeadline is nil (and blocks forever) unless we're shutting down
+func (c *Connection) shutdownDeadline() <-chan struct{} {
+	if c.shutdownCtx == nil {
+		return nil
+	}
+	return c.shutdownCtx.Done()
+}
+
+// drained tells if we're shutting down and there are no more calls to
+// wait for. The values which are waiting to be published are flushed.
+func (c *Connection) drained() bool {
+	if !c.shuttingDown || c.runningCalls > 0 || len(c.callQueue) > 0 {
+		return false
+	}
+
+	for {
+		select {
+		case ov := <-c.outgoingValues:
+			err := c.handleOutgoingValue(ov)
+			if err != nil {
+				c.err(&Error{Category: TypeMismatch, Topic: ov.value.topic, Err: err})
+			}
+		default:
+			return true
+		}
+	}
+}
+
+func (c *Connection) closeShutdownRequests() {
+	ch := c.shutdownRequests
+
+	defer close(ch)
+
+	for {
+		select {
+		case _ = <-ch:
+			// discard message to unblock the caller
+		case _ = <-c.thatsAllFolks:
+			return
+		}
+	}
+}
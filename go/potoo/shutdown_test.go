@@ -0,0 +1,69 @@
+package potoo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+)
+
+func TestShutdownDrainsCalls(t *testing.T) {
+	b := newFakeBroker()
+	started := make(chan struct{}, 16)
+	release := make(chan struct{})
+	svc := startService(t, b, ConnectionOptions{}, contracts.Map{
+		"slow": serialized(1, started, release),
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	call := callAsync(cl, "svc/slow")
+	<-started
+	done := make(chan error, 1)
+	go func() {
+		done <- svc.Shutdown(context.Background())
+	}()
+	eventually(t, "the service stops accepting calls", func() bool {
+		return !b.subscribed("_call/things/svc/slow")
+	})
+	contract, _ := b.retainedValue("_contract/things/svc")
+	if string(contract) == "null" {
+		t.Errorf("the contract was cleared before the calls finished")
+	}
+
+	close(release)
+	if o := <-call; o.err != nil || o.value.GetInt() != 1 {
+		t.Errorf("the call returned (%v, %v) during the shutdown", o.value, o.err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("shutdown failed: %s", err)
+	}
+	contract, _ = b.retainedValue("_contract/things/svc")
+	if string(contract) != "null" {
+		t.Errorf("the contract is %s after the shutdown", contract)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	b := newFakeBroker()
+	started := make(chan struct{}, 16)
+	release := make(chan struct{})
+	defer close(release)
+	svc := startService(t, b, ConnectionOptions{}, contracts.Map{
+		"slow": serialized(1, started, release),
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	callAsync(cl, "svc/slow")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := svc.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shutdown returned %v instead of giving up on the call", err)
+	}
+	if err := svc.Shutdown(context.Background()); err == nil {
+		t.Errorf("a dead connection was shut down again")
+	}
+}
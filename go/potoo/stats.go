@@ -0,0 +1,265 @@
+package potoo
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/bus"
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/types"
+)
+
+// statsKey is the key of the statistics subcontract in the root map
+const statsKey = "_stats"
+
+const defaultStatsInterval = 5 * time.Second
+
+// upper bounds (in seconds) of the call latency histogram buckets; there
+// is an implicit last bucket for slower calls
+var latencyBuckets = []float64{0.001, 0.01, 0.1, 1, 10}
+
+// counter is a number which is updated by the connection loop and sent
+// to its bus periodically, since the loop can't send to buses itself
+type counter struct {
+	n   float64
+	bus *bus.FloatBus
+}
+
+func newCounter() *counter {
+	return &counter{bus: bus.NewFloatBusWithOpts(0, &bus.Options{Deduplicate: true})}
+}
+
+func (c *counter) contract() contracts.Value {
+	return contracts.Value{Type: types.Float(), Bus: c.bus}
+}
+
+type callStats struct {
+	count    *counter   // handled calls
+	errors   *counter   // handled calls which failed
+	rejected *counter   // calls which weren't handled (e.g. rate limited)
+	latency  []*counter // cumulative, one for each bucket and one for +inf
+}
+
+type stats struct {
+	sync.Mutex
+
+	started    time.Time
+	uptime     *counter
+	reconnects *counter
+	calls      map[string]*callStats // by call topic
+	values     map[string]*counter   // publishes by value topic
+}
+
+func newStats() *stats {
+	return &stats{
+		started:    time.Now(),
+		uptime:     newCounter(),
+		reconnects: newCounter(),
+		calls:      make(map[string]*callStats),
+		values:     make(map[string]*counter),
+	}
+}
+
+// mountStats adds the statistics subcontract to the root of the contract
+// (if it is a map), keeping the counters of callables and values which
+// are still there
+func (c *Connection) mountStats(contract contracts.Contract) contracts.Contract {
+	m, ok := contract.(contracts.Map)
+	if !ok {
+		return contract
+	}
+
+	s := c.stats
+	s.Lock()
+	defer s.Unlock()
+
+	calls := make(map[string]*callStats)
+	values := make(map[string]*counter)
+	callsContract := make(contracts.Map)
+	valuesContract := make(contracts.Map)
+
+	contracts.Traverse(m, func(subcontr contracts.Contract, subtopic mqtt.Topic) {
+		switch subcontr.(type) {
+		case contracts.Callable:
+			topic := string(c.serviceTopic(mqtt.Topic("_call"), subtopic))
+			cs, ok := s.calls[topic]
+			if !ok {
+				cs = &callStats{count: newCounter(), errors: newCounter(), rejected: newCounter()}
+				for i := 0; i <= len(latencyBuckets); i++ {
+					cs.latency = append(cs.latency, newCounter())
+				}
+			}
+			calls[topic] = cs
+
+			latency := make(contracts.Map)
+			for i, bound := range latencyBuckets {
+				latency["le_"+strconv.FormatFloat(bound, 'g', -1, 64)] = cs.latency[i].contract()
+			}
+			latency["le_inf"] = cs.latency[len(latencyBuckets)].contract()
+
+			mountAt(callsContract, subtopic, contracts.Map{
+				"count":    cs.count.contract(),
+				"errors":   cs.errors.contract(),
+				"rejected": cs.rejected.contract(),
+				"latency":  latency,
+			})
+		case contracts.Value:
+			topic := string(c.serviceTopic(mqtt.Topic("_value"), subtopic))
+			publishes, ok := s.values[topic]
+			if !ok {
+				publishes = newCounter()
+			}
+			values[topic] = publishes
+
+			mountAt(valuesContract, subtopic, contracts.Map{
+				"publishes": publishes.contract(),
+			})
+		}
+	})
+	s.calls = calls
+	s.values = values
+
+	withStats := make(contracts.Map, len(m)+1)
+	for k := range m {
+		withStats[k] = m[k]
+	}
+	withStats[statsKey] = contracts.Map{
+		"uptime":     s.uptime.contract(),
+		"reconnects": s.reconnects.contract(),
+		"calls":      callsContract,
+		"values":     valuesContract,
+	}
+	return withStats
+}
+
+// mountAt puts the keys of sub into the map at the given path of m,
+// creating intermediate maps as needed
+func mountAt(m contracts.Map, path mqtt.Topic, sub contracts.Map) {
+	for _, key := range strings.Split(string(path), "/") {
+		next, ok := m[key].(contracts.Map)
+		if !ok {
+			next = make(contracts.Map)
+			m[key] = next
+		}
+		m = next
+	}
+	for k := range sub {
+		m[k] = sub[k]
+	}
+}
+
+func (c *Connection) recordCall(topic mqtt.Topic, started time.Time, failed bool) {
+	if c.stats == nil {
+		return
+	}
+	c.stats.Lock()
+	defer c.stats.Unlock()
+
+	cs, ok := c.stats.calls[string(topic)]
+	if !ok {
+		return
+	}
+	cs.count.n++
+	if failed {
+		cs.errors.n++
+	}
+
+	latency := time.Since(started).Seconds()
+	for i, bound := range latencyBuckets {
+		if latency <= bound {
+			cs.latency[i].n++
+		}
+	}
+	cs.latency[len(latencyBuckets)].n++
+}
+
+func (c *Connection) recordRejectedCall(topic mqtt.Topic) {
+	if c.stats == nil {
+		return
+	}
+	c.stats.Lock()
+	defer c.stats.Unlock()
+
+	if cs, ok := c.stats.calls[string(topic)]; ok {
+		cs.rejected.n++
+	}
+}
+
+func (c *Connection) recordValuePublish(topic mqtt.Topic) {
+	if c.stats == nil {
+		return
+	}
+	c.stats.Lock()
+	defer c.stats.Unlock()
+
+	if publishes, ok := c.stats.values[string(topic)]; ok {
+		publishes.n++
+	}
+}
+
+func (c *Connection) recordReconnect() {
+	if c.stats == nil {
+		return
+	}
+	c.stats.Lock()
+	defer c.stats.Unlock()
+
+	c.stats.reconnects.n++
+}
+
+// reportStats sends the counters to their buses periodically until the
+// connection dies
+func (c *Connection) reportStats() {
+	interval := c.opts.StatsInterval
+	if interval == 0 {
+		interval = defaultStatsInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.flushStats()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Connection) flushStats() {
+	type update struct {
+		bus *bus.FloatBus
+		n   float64
+	}
+	var updates []update
+	add := func(ctr *counter) {
+		updates = append(updates, update{bus: ctr.bus, n: ctr.n})
+	}
+
+	c.stats.Lock()
+	c.stats.uptime.n = time.Since(c.stats.started).Seconds()
+	add(c.stats.uptime)
+	add(c.stats.reconnects)
+	for _, cs := range c.stats.calls {
+		add(cs.count)
+		add(cs.errors)
+		add(cs.rejected)
+		for _, ctr := range cs.latency {
+			add(ctr)
+		}
+	}
+	for _, ctr := range c.stats.values {
+		add(ctr)
+	}
+	c.stats.Unlock()
+
+	// sending blocks until the connection loop publishes the value, and
+	// the loop may be waiting for the lock
+	for _, u := range updates {
+		u.bus.SendV(u.n)
+	}
+}
@@ -0,0 +1,59 @@
+package potoo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/bus"
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+func TestStats(t *testing.T) {
+	b := newFakeBroker()
+	temp := bus.NewIntBus(1)
+	startService(t, b, ConnectionOptions{Stats: true, StatsInterval: 10 * time.Millisecond}, contracts.Map{
+		"temp": contracts.Value{Type: types.Int(), Bus: temp},
+		"check": contracts.Callable{
+			Argument:  types.Int(),
+			Retval:    types.Int(),
+			RateLimit: &contracts.RateLimit{Rate: 0.001, Burst: 3},
+			ErrHandler: func(a *fastjson.Arena, arg *fastjson.Value) (*fastjson.Value, error) {
+				if arg.GetInt() < 0 {
+					return nil, errors.New("negative")
+				}
+				return arg, nil
+			},
+		},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	contract, _ := b.retainedValue("_contract/things/svc")
+	if !strings.Contains(string(contract), `"_stats"`) {
+		t.Fatalf("statistics aren't mounted in %s", contract)
+	}
+
+	for _, arg := range []int{1, -1, 2, 3} {
+		cl.Call(context.Background(), mqtt.Topic("svc/check"), q.Int(arg))
+	}
+	temp.SendV(2)
+
+	for topic, want := range map[string]string{
+		"_stats/calls/check/count":          "3",
+		"_stats/calls/check/errors":         "1",
+		"_stats/calls/check/rejected":       "1",
+		"_stats/calls/check/latency/le_inf": "3",
+		"_stats/values/temp/publishes":      "2",
+	} {
+		eventually(t, topic+" is "+want, func() bool {
+			value, _ := b.retainedValue("_value/things/svc/" + topic)
+			return string(value) == want
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package potoo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dexterlb/potoo/go/potoo/codec"
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+// the number of chunks which are buffered for a stream consumer
+const streamBufferSize = 64
+
+var errStreamOverflow = errors.New("stream consumer is too slow, chunks were lost")
+
+// Stream is the result of CallStream. Chunks is closed when the stream
+// ends, after which Err tells why.
+type Stream struct {
+	Chunks <-chan *fastjson.Value
+	err    error
+}
+
+// Err returns the error which ended the stream, or nil if the service
+// ended it normally. It may only be called after Chunks is closed.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// CallStream performs a call to a streaming callable (see Call). The
+// chunks of the reply are delivered via the returned stream, which must
+// be consumed until its end (or ctx must be cancelled). CallTimeout
+// doesn't apply to streams.
+func (c *Connection) CallStream(ctx context.Context, topic mqtt.Topic, argument *fastjson.Value) (*Stream, error) {
+	replies := make(chan []byte, streamBufferSize)
+	call := outgoingCall{
+		topic:    topic,
+		argument: argument,
+		token:    randomString(16),
+		replies:  replies,
+	}
+
+	acc, err := c.startCall(call)
+	if err != nil {
+		c.forgetPendingCall(call.token)
+		return nil, err
+	}
+	if !acc.stream {
+		c.forgetPendingCall(call.token)
+		return nil, fmt.Errorf("cannot call '%s': callable is not streaming", string(topic))
+	}
+
+	chunks := make(chan *fastjson.Value)
+	s := &Stream{Chunks: chunks}
+	go func() {
+		defer close(chunks)
+		defer c.forgetPendingCall(call.token)
+
+		s.err = c.consumeStream(ctx, topic, acc.retval, acc.encoding, replies, chunks)
+	}()
+	return s, nil
+}
+
+func (c *Connection) consumeStream(ctx context.Context, topic mqtt.Topic, t types.Type, enc codec.Codec, replies <-chan []byte, chunks chan<- *fastjson.Value) error {
+	for {
+		var data []byte
+		var ok bool
+		select {
+		case data, ok = <-replies:
+			if !ok {
+				return fmt.Errorf("stream from '%s' failed: %w", string(topic), errStreamOverflow)
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("stream from '%s' failed: %w", string(topic), ctx.Err())
+		case <-c.thatsAllFolks:
+			return errConnectionDead
+		}
+
+		kind, value := splitReply(data, enc)
+		if kind == "end" {
+			return nil
+		}
+		if kind != "chunk" {
+			_, err := parseReply(data, enc)
+			if err == nil {
+				err = fmt.Errorf("unexpected non-stream reply")
+			}
+			return fmt.Errorf("stream from '%s' failed: %w", string(topic), err)
+		}
+
+		chunk, err := codec.Or(enc).Unmarshal(nil, nil, value)
+		if err != nil {
+			return fmt.Errorf("unable to parse chunk from '%s': %s", string(topic), err)
+		}
+		err = types.TypeCheck(chunk, t)
+		if err != nil {
+			return fmt.Errorf("'%s' streamed value of wrong type: %s", string(topic), err)
+		}
+
+		select {
+		case chunks <- chunk:
+		case <-ctx.Done():
+			return fmt.Errorf("stream from '%s' failed: %w", string(topic), ctx.Err())
+		case <-c.thatsAllFolks:
+			return errConnectionDead
+		}
+	}
+}
+
+// streamEmitter returns the emit function for a StreamHandler, which
+// publishes chunks (via the connection loop) to the caller
+func (c *Connection) streamEmitter(msg mqtt.Message, result callResult, callable *contracts.Callable) func(*fastjson.Value) error {
+	return func(v *fastjson.Value) error {
+		err := c.typeCheck(c.validation.Results, v, callable.Retval, msg.Topic, "streamed value")
+		if err != nil {
+			return newError(TypeMismatch, msg.Topic, "streamed value has wrong type: %w", err)
+		}
+		if result.topic == nil {
+			// noone is listening
+			return nil
+		}
+
+		payload := appendReplyHead(nil, result.version, result.token, "chunk", result.encoding)
+		payload = codec.Or(result.encoding).Marshal(payload, v)
+		payload = appendReplyTail(payload, result.version)
+
+		c.deathMutex.Lock()
+		defer c.deathMutex.Unlock()
+		if c.dead {
+			return errConnectionDead
+		}
+		c.streamChunks <- mqtt.Message{Topic: result.topic, Payload: payload}
+		return nil
+	}
+}
@@ -0,0 +1,114 @@
+package potoo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+func countdown(fail error) contracts.Callable {
+	return contracts.Callable{
+		Argument: types.Int(),
+		Retval:   types.Int(),
+		StreamHandler: func(ctx context.Context, a *fastjson.Arena, arg *fastjson.Value, emit func(*fastjson.Value) error) error {
+			for i := arg.GetInt(); i > 0; i-- {
+				err := emit(a.NewNumberInt(i))
+				if err != nil {
+					return err
+				}
+			}
+			return fail
+		},
+	}
+}
+
+func streamValues(t *testing.T, s *Stream) []string {
+	t.Helper()
+
+	var values []string
+	for v := range s.Chunks {
+		values = append(values, v.String())
+	}
+	return values
+}
+
+func TestStream(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"countdown": countdown(nil),
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	s, err := cl.CallStream(context.Background(), mqtt.Topic("svc/countdown"), q.Int(3))
+	if err != nil {
+		t.Fatalf("unable to start stream: %s", err)
+	}
+	values := streamValues(t, s)
+	if len(values) != 3 || values[0] != "3" || values[2] != "1" || s.Err() != nil {
+		t.Errorf("stream returned %v and %v", values, s.Err())
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"countdown": countdown(codedError{}),
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	s, err := cl.CallStream(context.Background(), mqtt.Topic("svc/countdown"), q.Int(2))
+	if err != nil {
+		t.Fatalf("unable to start stream: %s", err)
+	}
+	values := streamValues(t, s)
+	var rerr *RemoteError
+	if len(values) != 2 || !errors.As(s.Err(), &rerr) || rerr.Code != "broken_light" {
+		t.Errorf("stream returned %v and %v instead of failing", values, s.Err())
+	}
+}
+
+func TestStreamWrongType(t *testing.T) {
+	b := newFakeBroker()
+	emitted := make(chan error, 1)
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"words": contracts.Callable{
+			Argument: types.Null(),
+			Retval:   types.Int(),
+			StreamHandler: func(ctx context.Context, a *fastjson.Arena, arg *fastjson.Value, emit func(*fastjson.Value) error) error {
+				emitted <- emit(a.NewString("one"))
+				return nil
+			},
+		},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	s, err := cl.CallStream(context.Background(), mqtt.Topic("svc/words"), q.Json(nil))
+	if err != nil {
+		t.Fatalf("unable to start stream: %s", err)
+	}
+	if err := <-emitted; err == nil {
+		t.Errorf("emitting a value of the wrong type didn't fail")
+	}
+	if values := streamValues(t, s); len(values) != 0 {
+		t.Errorf("stream returned %v", values)
+	}
+}
+
+func TestStreamNotStreaming(t *testing.T) {
+	b := newFakeBroker()
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"fast": fast,
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	_, err := cl.CallStream(context.Background(), mqtt.Topic("svc/fast"), q.Json(nil))
+	if err == nil {
+		t.Errorf("streaming call to a normal callable didn't fail")
+	}
+}
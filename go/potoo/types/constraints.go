@@ -0,0 +1,247 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/valyala/fastjson"
+)
+
+// Metadata keys which TypeCheck enforces:
+//   - "min" and "max" bound ints and floats (inclusive)
+//   - "min_length" and "max_length" bound the number of characters of
+//     strings and the number of items of lists
+//   - "pattern" is a regular expression (in Go syntax) which strings must
+//     contain a match of
+//
+// Ints must also be integral. Other metadata keys are only informative.
+const (
+	MetaMin       = "min"
+	MetaMax       = "max"
+	MetaMinLength = "min_length"
+	MetaMaxLength = "max_length"
+	MetaPattern   = "pattern"
+)
+
+var patternCache sync.Map // pattern string -> compiledPattern
+
+type compiledPattern struct {
+	re  *regexp.Regexp
+	err error
+}
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if p, ok := patternCache.Load(pattern); ok {
+		return p.(compiledPattern).re, p.(compiledPattern).err
+	}
+	re, err := regexp.Compile(pattern)
+	patternCache.Store(pattern, compiledPattern{re: re, err: err})
+	return re, err
+}
+
+// metaNumber returns the numeric constraint with the given key
+func metaNumber(meta MetaData, key string) (float64, bool, error) {
+	v, ok := meta[key]
+	if !ok {
+		return 0, false, nil
+	}
+	f, err := v.Float64()
+	if err != nil {
+		return 0, false, fmt.Errorf("constraint '%s' is not a number: %s", key, v)
+	}
+	return f, true, nil
+}
+
+func checkRange(meta MetaData, x float64, what string) error {
+	min, ok, err := metaNumber(meta, MetaMin)
+	if err != nil {
+		return err
+	}
+	if ok && x < min {
+		return fmt.Errorf("%s is less than the minimum %v", what, min)
+	}
+
+	max, ok, err := metaNumber(meta, MetaMax)
+	if err != nil {
+		return err
+	}
+	if ok && x > max {
+		return fmt.Errorf("%s is greater than the maximum %v", what, max)
+	}
+	return nil
+}
+
+func checkLength(meta MetaData, n int, what string) error {
+	min, ok, err := metaNumber(meta, MetaMinLength)
+	if err != nil {
+		return err
+	}
+	if ok && float64(n) < min {
+		return fmt.Errorf("%s has length %d, which is less than the minimum %v", what, n, min)
+	}
+
+	max, ok, err := metaNumber(meta, MetaMaxLength)
+	if err != nil {
+		return err
+	}
+	if ok && float64(n) > max {
+		return fmt.Errorf("%s has length %d, which is greater than the maximum %v", what, n, max)
+	}
+	return nil
+}
+
+// checkConstraints checks v against the metadata constraints of t, once
+// it's known that v has the right shape
+func checkConstraints(v *fastjson.Value, t Type) error {
+	switch t.T.(type) {
+	case *TInt:
+		f := v.GetFloat64()
+		if math.Trunc(f) != f {
+			return fmt.Errorf("%s is not an integer", v)
+		}
+		if len(t.Meta) == 0 {
+			return nil
+		}
+		return checkRange(t.Meta, f, v.String())
+	case *TFloat:
+		if len(t.Meta) == 0 {
+			return nil
+		}
+		return checkRange(t.Meta, v.GetFloat64(), v.String())
+	case *TString:
+		if len(t.Meta) == 0 {
+			return nil
+		}
+		s := v.GetStringBytes()
+		err := checkLength(t.Meta, utf8.RuneCount(s), "string")
+		if err != nil {
+			return err
+		}
+		if p, ok := t.Meta[MetaPattern]; ok {
+			pattern, err := p.StringBytes()
+			if err != nil {
+				return fmt.Errorf("constraint '%s' is not a string: %s", MetaPattern, p)
+			}
+			re, err := compilePattern(string(pattern))
+			if err != nil {
+				return fmt.Errorf("invalid pattern '%s': %s", string(pattern), err)
+			}
+			if !re.Match(s) {
+				return fmt.Errorf("string doesn't match the pattern '%s'", string(pattern))
+			}
+		}
+		return nil
+	case *TList:
+		if len(t.Meta) == 0 {
+			return nil
+		}
+		return checkLength(t.Meta, len(v.GetArray()), "list")
+	default:
+		return nil
+	}
+}
+
+// ValidateConstraints checks the constraint metadata of t and the types
+// it contains: bounds must be numbers, minimums mustn't be greater than
+// maximums, and patterns must compile
+func ValidateConstraints(t Type) error {
+	var err error
+	switch tt := t.T.(type) {
+	case *TInt, *TFloat:
+		err = validateBounds(t.Meta, MetaMin, MetaMax)
+	case *TString:
+		err = validateBounds(t.Meta, MetaMinLength, MetaMaxLength)
+		if err == nil {
+			err = validatePattern(t.Meta)
+		}
+	case *TList:
+		err = validateBounds(t.Meta, MetaMinLength, MetaMaxLength)
+		if err == nil {
+			err = ValidateConstraints(tt.ValueType)
+		}
+	case *TMap:
+		err = ValidateConstraints(tt.KeyType)
+		if err == nil {
+			err = ValidateConstraints(tt.ValueType)
+		}
+	case *TUnion:
+		for i := 0; i < len(tt.Alts) && err == nil; i++ {
+			err = ValidateConstraints(tt.Alts[i])
+		}
+	case *TStruct:
+		for _, field := range tt.Fields {
+			if err = ValidateConstraints(field); err != nil {
+				break
+			}
+		}
+	case *TTuple:
+		for i := 0; i < len(tt.Fields) && err == nil; i++ {
+			err = ValidateConstraints(tt.Fields[i])
+		}
+	}
+	return err
+}
+
+func validateBounds(meta MetaData, minKey string, maxKey string) error {
+	min, hasMin, err := metaNumber(meta, minKey)
+	if err != nil {
+		return err
+	}
+	max, hasMax, err := metaNumber(meta, maxKey)
+	if err != nil {
+		return err
+	}
+	if hasMin && hasMax && min > max {
+		return fmt.Errorf("constraint '%s' (%v) is greater than '%s' (%v)", minKey, min, maxKey, max)
+	}
+	return nil
+}
+
+func validatePattern(meta MetaData) error {
+	p, ok := meta[MetaPattern]
+	if !ok {
+		return nil
+	}
+	pattern, err := p.StringBytes()
+	if err != nil {
+		return fmt.Errorf("constraint '%s' is not a string: %s", MetaPattern, p)
+	}
+	_, err = compilePattern(string(pattern))
+	if err != nil {
+		return fmt.Errorf("invalid pattern '%s': %s", string(pattern), err)
+	}
+	return nil
+}
+
+// constraintsImply tells if the constraints of super hold for all values
+// which satisfy the constraints of sub (whose length is known if fixed
+// isn't negative)
+func constraintsImply(sub MetaData, super MetaData, fixed int) bool {
+	bound := func(key string, lower bool) bool {
+		s, ok, err := metaNumber(super, key)
+		if !ok {
+			return err == nil
+		}
+		if fixed >= 0 && (key == MetaMinLength || key == MetaMaxLength) {
+			return (lower && float64(fixed) >= s) || (!lower && float64(fixed) <= s)
+		}
+		b, ok, err := metaNumber(sub, key)
+		if !ok || err != nil {
+			return false
+		}
+		return (lower && b >= s) || (!lower && b <= s)
+	}
+	if !bound(MetaMin, true) || !bound(MetaMax, false) ||
+		!bound(MetaMinLength, true) || !bound(MetaMaxLength, false) {
+		return false
+	}
+
+	if p, ok := super[MetaPattern]; ok {
+		q, ok := sub[MetaPattern]
+		return ok && q.String() == p.String()
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package types
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fastjson"
+)
+
+func TestConstraints(t *testing.T) {
+	cases := []struct {
+		t     Type
+		value string
+		err   string // a part of the error, or "" if the value matches
+	}{
+		{Int(), `3`, ""},
+		{Int(), `3.0`, ""},
+		{Int(), `1e2`, ""},
+		{Int(), `3.7`, "3.7 is not an integer"},
+		{Int().M(meta(`{"min": 0, "max": 20}`)), `0`, ""},
+		{Int().M(meta(`{"min": 0, "max": 20}`)), `20`, ""},
+		{Int().M(meta(`{"min": 0, "max": 20}`)), `-1`, "-1 is less than the minimum 0"},
+		{Int().M(meta(`{"min": 0, "max": 20}`)), `21`, "21 is greater than the maximum 20"},
+		{Int().M(meta(`{"min": 0, "max": 20}`)), `2.5`, "not an integer"},
+
+		{Float().M(meta(`{"min": 0.5}`)), `0.5`, ""},
+		{Float().M(meta(`{"min": 0.5}`)), `0.4`, "less than the minimum 0.5"},
+		{Float().M(meta(`{"max": -1}`)), `-0.5`, "greater than the maximum -1"},
+		{Float().M(meta(`{"max": 1}`)), `"1"`, "type mismatch"},
+
+		// lengths are counted in characters
+		{String().M(meta(`{"max_length": 3}`)), `"äöü"`, ""},
+		{String().M(meta(`{"max_length": 3}`)), `"abcd"`, "string has length 4, which is greater than the maximum 3"},
+		{String().M(meta(`{"min_length": 2}`)), `"a"`, "string has length 1, which is less than the minimum 2"},
+		{String().M(meta(`{"min_length": 2}`)), `"ab"`, ""},
+		{String().M(meta(`{"pattern": "^[a-z]+$"}`)), `"abc"`, ""},
+		{String().M(meta(`{"pattern": "^[a-z]+$"}`)), `"ab1"`, "doesn't match the pattern '^[a-z]+$'"},
+		{String().M(meta(`{"pattern": "b"}`)), `"abc"`, ""},
+
+		{List(Int()).M(meta(`{"min_length": 1, "max_length": 2}`)), `[1]`, ""},
+		{List(Int()).M(meta(`{"min_length": 1, "max_length": 2}`)), `[]`, "list has length 0, which is less than the minimum 1"},
+		{List(Int()).M(meta(`{"min_length": 1, "max_length": 2}`)), `[1,2,3]`, "list has length 3, which is greater than the maximum 2"},
+
+		// other metadata is only informative
+		{Int().M(meta(`{"description": "temperature", "unit": "C"}`)), `3`, ""},
+		{Bool().M(meta(`{"min": 1}`)), `true`, ""},
+	}
+
+	for _, c := range cases {
+		err := TypeCheck(fastjson.MustParse(c.value), c.t)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s doesn't match %s: %s", c.value, c.t, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s against %s: got %v instead of an error with '%s'", c.value, c.t, err, c.err)
+		}
+	}
+}
+
+func TestValidateConstraints(t *testing.T) {
+	cases := []struct {
+		t   Type
+		err string // a part of the error, or "" if the metadata is valid
+	}{
+		{Int().M(meta(`{"min": 0, "max": 0}`)), ""},
+		{String().M(meta(`{"min_length": 1, "max_length": 2, "pattern": "^a"}`)), ""},
+		{Bool().M(meta(`{"min": "informative"}`)), ""},
+		{String().M(meta(`{"min": 2, "max": 1}`)), ""},
+
+		{Int().M(meta(`{"min": "zero"}`)), "constraint 'min' is not a number"},
+		{Float().M(meta(`{"max": null}`)), "constraint 'max' is not a number"},
+		{String().M(meta(`{"max_length": "x"}`)), "constraint 'max_length' is not a number"},
+		{String().M(meta(`{"pattern": "("}`)), "invalid pattern '('"},
+		{String().M(meta(`{"pattern": 5}`)), "constraint 'pattern' is not a string"},
+		{Int().M(meta(`{"min": 2, "max": 1}`)), "constraint 'min' (2) is greater than 'max' (1)"},
+		{List(Int()).M(meta(`{"min_length": 3, "max_length": 2}`)), "constraint 'min_length' (3) is greater than 'max_length' (2)"},
+
+		// the types inside others are checked too
+		{List(Float().M(meta(`{"min": 1, "max": 0}`))), "is greater than 'max'"},
+		{Map(String().M(meta(`{"pattern": "["}`)), Int()), "invalid pattern '['"},
+		{Struct(map[string]Type{"a": Int(), "b": Int().M(meta(`{"max": "x"}`))}), "constraint 'max' is not a number"},
+		{Tuple(Int(), String().M(meta(`{"min_length": -1, "max_length": -2}`))), "is greater than 'max_length'"},
+		{Union(Null(), Int().M(meta(`{"min": true}`))), "constraint 'min' is not a number"},
+	}
+
+	for _, c := range cases {
+		err := ValidateConstraints(c.t)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %s", c.t, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: got %v instead of an error with '%s'", c.t, err, c.err)
+		}
+	}
+}
+
+func TestConstraintPath(t *testing.T) {
+	cases := []struct {
+		t     Type
+		value string
+		path  string
+	}{
+		{Int().M(meta(`{"min": 0}`)), `-1`, ""},
+		{
+			Struct(map[string]Type{"a": List(Int().M(meta(`{"min": 0}`)))}),
+			`{"a": [1, -1]}`,
+			"a/1",
+		},
+		{
+			Map(String(), Tuple(String().M(meta(`{"pattern": "^x"}`)), Int())),
+			`{"k": ["x", 1], "l": ["y", 1]}`,
+			"l/0",
+		},
+		{
+			List(List(Int())).M(meta(`{"max_length": 5}`)),
+			`[[1], [2, 2.5]]`,
+			"1/1",
+		},
+		{
+			Struct(map[string]Type{"a": List(Int()).M(meta(`{"max_length": 1}`))}),
+			`{"a": [1, 2]}`,
+			"a",
+		},
+	}
+
+	for _, c := range cases {
+		err := TypeCheck(fastjson.MustParse(c.value), c.t)
+		var cerr *CheckError
+		if !errors.As(err, &cerr) {
+			t.Errorf("%s against %s: got %v instead of a CheckError", c.value, c.t, err)
+			continue
+		}
+		if path := strings.Join(cerr.Path, "/"); path != c.path {
+			t.Errorf("%s against %s: the error is at '%s' instead of '%s'", c.value, c.t, path, c.path)
+		}
+	}
+}
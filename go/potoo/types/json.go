@@ -14,10 +14,16 @@ func MustDecode(v *fastjson.Value) Type {
 	return t
 }
 
+// SchemaVersion is the version of the schemas we understand
+const SchemaVersion = "0"
+
 func DecodeSchema(v *fastjson.Value) (Type, error) {
 	if v == nil {
 		return Type{}, fmt.Errorf("item does not exist")
 	}
+	if version := v.GetStringBytes("version"); version != nil && string(version) != SchemaVersion {
+		return Type{}, fmt.Errorf("unsupported schema version: %s", string(version))
+	}
 	keyVal := v.Get("t")
 	if keyVal == nil {
 		return Type{}, fmt.Errorf("no t field in schema")
@@ -61,14 +67,28 @@ func Decode(v *fastjson.Value) (Type, error) {
 }
 
 func EncodeSchema(a *fastjson.Arena, t Type) *fastjson.Value {
+	return EncodeSchemaAs(a, t, "json")
+}
+
+// EncodeSchemaAs encodes a schema for values in the given encoding
+func EncodeSchemaAs(a *fastjson.Arena, t Type, encoding string) *fastjson.Value {
 	o := a.NewObject()
 	o.Set("t", Encode(a, t))
-	o.Set("version", a.NewString("0"))
-	o.Set("encoding", a.NewString("json"))
+	o.Set("version", a.NewString(SchemaVersion))
+	o.Set("encoding", a.NewString(encoding))
 	o.Set("meta", a.NewObject())
 	return o
 }
 
+// SchemaEncoding returns the encoding of a schema ("json" if unspecified)
+func SchemaEncoding(v *fastjson.Value) string {
+	encoding := v.GetStringBytes("encoding")
+	if len(encoding) == 0 {
+		return "json"
+	}
+	return string(encoding)
+}
+
 func Encode(a *fastjson.Arena, t Type) *fastjson.Value {
 	o := a.NewObject()
 	o.Set("kind", a.NewString(t.T.typeKey()))
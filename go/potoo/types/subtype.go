@@ -0,0 +1,113 @@
+package types
+
+// IsSubtype tells if every value of type sub is also a value of type
+// super. The analysis is conservative: it may answer false for some
+// types which are in fact subtypes (e.g. bool and the union of the true
+// and false literals). Constraint metadata (see MetaMin etc.) of super
+// must be implied by the constraints of sub.
+func IsSubtype(sub Type, super Type) bool {
+	if _, ok := sub.T.(*TVoid); ok {
+		return true // void is uninhabitable
+	}
+
+	if u, ok := sub.T.(*TUnion); ok {
+		for _, alt := range u.Alts {
+			if !IsSubtype(alt, super) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if u, ok := super.T.(*TUnion); ok {
+		for _, alt := range u.Alts {
+			if IsSubtype(sub, alt) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if l, ok := sub.T.(*TLiteral); ok {
+		return TypeCheck(l.Value, super) == nil
+	}
+
+	switch p := super.T.(type) {
+	case *TNull:
+		_, ok := sub.T.(*TNull)
+		return ok
+	case *TBool:
+		_, ok := sub.T.(*TBool)
+		return ok
+	case *TInt:
+		_, ok := sub.T.(*TInt)
+		return ok && constraintsImply(sub.Meta, super.Meta, -1)
+	case *TFloat:
+		switch sub.T.(type) {
+		case *TInt, *TFloat:
+			return constraintsImply(sub.Meta, super.Meta, -1)
+		}
+		return false
+	case *TString:
+		_, ok := sub.T.(*TString)
+		return ok && constraintsImply(sub.Meta, super.Meta, -1)
+	case *TMap:
+		switch b := sub.T.(type) {
+		case *TMap:
+			return IsSubtype(b.KeyType, p.KeyType) && IsSubtype(b.ValueType, p.ValueType)
+		case *TStruct:
+			for _, field := range b.Fields {
+				if !IsSubtype(field, p.ValueType) {
+					return false
+				}
+			}
+			return true
+		}
+		return false
+	case *TList:
+		switch b := sub.T.(type) {
+		case *TList:
+			return IsSubtype(b.ValueType, p.ValueType) && constraintsImply(sub.Meta, super.Meta, -1)
+		case *TTuple:
+			for _, field := range b.Fields {
+				if !IsSubtype(field, p.ValueType) {
+					return false
+				}
+			}
+			return constraintsImply(nil, super.Meta, len(b.Fields))
+		}
+		return false
+	case *TTuple:
+		b, ok := sub.T.(*TTuple)
+		if !ok || len(b.Fields) != len(p.Fields) {
+			return false
+		}
+		for i := range b.Fields {
+			if !IsSubtype(b.Fields[i], p.Fields[i]) {
+				return false
+			}
+		}
+		return true
+	case *TStruct:
+		b, ok := sub.T.(*TStruct)
+		if !ok || len(b.Fields) != len(p.Fields) {
+			return false
+		}
+		for name, field := range b.Fields {
+			superField, ok := p.Fields[name]
+			if !ok || !IsSubtype(field, superField) {
+				return false
+			}
+		}
+		return true
+	default:
+		// void and literals have no subtypes besides void, empty unions
+		// and literals, which are handled above
+		return false
+	}
+}
+
+// Equivalent tells if two types have the same values
+func Equivalent(a Type, b Type) bool {
+	return IsSubtype(a, b) && IsSubtype(b, a)
+}
@@ -0,0 +1,117 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/valyala/fastjson"
+)
+
+// meta parses a JSON object into metadata
+func meta(s string) MetaData {
+	m := make(MetaData)
+	fastjson.MustParse(s).GetObject().Visit(func(k []byte, v *fastjson.Value) {
+		m[string(k)] = v
+	})
+	return m
+}
+
+func literal(s string) Type {
+	return Literal(fastjson.MustParse(s))
+}
+
+func TestIsSubtype(t *testing.T) {
+	cases := []struct {
+		sub   Type
+		super Type
+		want  bool
+	}{
+		{Void(), Int(), true},
+		{Int(), Void(), false},
+		{Null(), Null(), true},
+		{Null(), Bool(), false},
+		{Bool(), Bool(), true},
+		{Int(), Float(), true},
+		{Float(), Int(), false},
+		{String(), Int(), false},
+
+		{Int().M(meta(`{"min": 0, "max": 10}`)), Int().M(meta(`{"min": -5}`)), true},
+		{Int().M(meta(`{"min": 0}`)), Int().M(meta(`{"min": 1}`)), false},
+		{Int(), Int().M(meta(`{"min": 0}`)), false},
+		{Int().M(meta(`{"min": 0}`)), Int(), true},
+		{Int().M(meta(`{"min": 0}`)), Float().M(meta(`{"min": 0}`)), true},
+		{Int().M(meta(`{"min": 1}`)), Int().M(meta(`{"min": "one"}`)), false},
+		{Int().M(meta(`{"description": "a"}`)), Int().M(meta(`{"description": "b"}`)), true},
+		{String().M(meta(`{"max_length": 2}`)), String().M(meta(`{"max_length": 3}`)), true},
+		{String(), String().M(meta(`{"max_length": 3}`)), false},
+		{String().M(meta(`{"pattern": "^a"}`)), String().M(meta(`{"pattern": "^a"}`)), true},
+		{String().M(meta(`{"pattern": "^ab"}`)), String().M(meta(`{"pattern": "^a"}`)), false},
+		{String().M(meta(`{"pattern": "^a"}`)), String(), true},
+
+		{literal(`3`), Int(), true},
+		{literal(`3`), Int().M(meta(`{"max": 2}`)), false},
+		{literal(`"a"`), Int(), false},
+		{literal(`"a"`), literal(`"a"`), true},
+		{Int(), literal(`3`), false},
+
+		{Union(Int(), Null()), Union(Float(), Null()), true},
+		{Union(Int(), String()), Int(), false},
+		{Int(), Union(String(), Float()), true},
+		{Int(), Union(String(), Null()), false},
+		{Union(), Int(), true},
+		{Int(), Union(), false},
+		// the analysis is conservative
+		{Bool(), Union(literal(`true`), literal(`false`)), false},
+
+		{Map(String(), Int()), Map(String(), Float()), true},
+		{Map(String(), Float()), Map(String(), Int()), false},
+		{Struct(map[string]Type{"a": Int()}), Map(String(), Float()), true},
+		{Struct(map[string]Type{"a": String()}), Map(String(), Int()), false},
+		{Map(String(), Int()), Struct(map[string]Type{"a": Int()}), false},
+
+		{List(Int()), List(Float()), true},
+		{List(Float()), List(Int()), false},
+		{List(Int()).M(meta(`{"max_length": 3}`)), List(Int()).M(meta(`{"max_length": 5}`)), true},
+		{List(Int()), List(Int()).M(meta(`{"max_length": 5}`)), false},
+		{Tuple(Int(), Int()), List(Float()).M(meta(`{"min_length": 1, "max_length": 2}`)), true},
+		{Tuple(Int(), Int(), Int()), List(Int()).M(meta(`{"max_length": 2}`)), false},
+		{Tuple(Int(), String()), List(Int()), false},
+		{List(Int()), Tuple(Int()), false},
+
+		{Tuple(Int(), Int()), Tuple(Float(), Int()), true},
+		{Tuple(Int()), Tuple(Int(), Int()), false},
+		{Tuple(Float(), Int()), Tuple(Int(), Int()), false},
+
+		{Struct(map[string]Type{"a": Int(), "b": String()}), Struct(map[string]Type{"a": Float(), "b": String()}), true},
+		{Struct(map[string]Type{"a": Int()}), Struct(map[string]Type{"a": Int(), "b": Int()}), false},
+		{Struct(map[string]Type{"a": Int(), "b": Int()}), Struct(map[string]Type{"a": Int()}), false},
+		{Struct(map[string]Type{"a": Int()}), Struct(map[string]Type{"b": Int()}), false},
+	}
+
+	for _, c := range cases {
+		if got := IsSubtype(c.sub, c.super); got != c.want {
+			t.Errorf("IsSubtype(%s, %s) is %v", c.sub, c.super, got)
+		}
+	}
+}
+
+func TestEquivalent(t *testing.T) {
+	cases := []struct {
+		a    Type
+		b    Type
+		want bool
+	}{
+		{Int(), Int(), true},
+		{Int(), Float(), false},
+		{Int().M(meta(`{"min": 0}`)), Int().M(meta(`{"min": 0}`)), true},
+		{Int().M(meta(`{"min": 0}`)), Int().M(meta(`{"min": 0.0}`)), true},
+		{Int().M(meta(`{"min": 0}`)), Int(), false},
+		{Union(Int(), Null()), Union(Null(), Int()), true},
+		{Struct(map[string]Type{"a": Int()}), Struct(map[string]Type{"a": Int()}), true},
+	}
+
+	for _, c := range cases {
+		if got := Equivalent(c.a, c.b); got != c.want {
+			t.Errorf("Equivalent(%s, %s) is %v", c.a, c.b, got)
+		}
+	}
+}
@@ -2,16 +2,33 @@ package types
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/valyala/fastjson"
 )
 
+// CheckError is the error returned by TypeCheck. Path holds the struct
+// fields, map keys and list or tuple indices which lead to the part of the
+// value that doesn't match.
+type CheckError struct {
+	Path []string
+	Err  error
+}
+
+func (e *CheckError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
 func TypeCheck(v *fastjson.Value, t Type) error {
 	var err error
 	switch typ := t.T.(type) {
 	case *TVoid:
-		return fmt.Errorf("trying to typecheck a value against Void, which is uninhabitable")
+		return &CheckError{Err: fmt.Errorf("trying to typecheck a value against Void, which is uninhabitable")}
 	case *TNull:
 		if v.Type() == fastjson.TypeNull {
 			return nil
@@ -22,21 +39,27 @@ func TypeCheck(v *fastjson.Value, t Type) error {
 		}
 	case *TInt, *TFloat:
 		if v.Type() == fastjson.TypeNumber {
-			return nil
+			err = checkConstraints(v, t)
+			if err == nil {
+				return nil
+			}
 		}
 	case *TString:
 		if v.Type() == fastjson.TypeString {
-			return nil
+			err = checkConstraints(v, t)
+			if err == nil {
+				return nil
+			}
 		}
 	case *TLiteral:
 		if sameValue(v, typ.Value) {
 			return nil
 		} else {
-			return fmt.Errorf(
+			return &CheckError{Err: fmt.Errorf(
 				"literal value '%s' doesn't match '%s'",
 				v.String(),
 				typ.Value.String(),
-			)
+			)}
 		}
 	case *TMap:
 		var o *fastjson.Object
@@ -46,7 +69,7 @@ func TypeCheck(v *fastjson.Value, t Type) error {
 				if err != nil {
 					return
 				}
-				err = TypeCheck(v2, typ.ValueType)
+				err = checkAt(v2, typ.ValueType, string(key))
 			})
 		}
 		if err == nil {
@@ -58,11 +81,12 @@ func TypeCheck(v *fastjson.Value, t Type) error {
 		if err == nil {
 			if len(a) != len(typ.Fields) {
 				err = fmt.Errorf("number of fields differs")
-			}
-			for i := range a {
-				err = TypeCheck(a[i], typ.Fields[i])
-				if err != nil {
-					break
+			} else {
+				for i := range a {
+					err = checkAt(a[i], typ.Fields[i], strconv.Itoa(i))
+					if err != nil {
+						break
+					}
 				}
 			}
 		}
@@ -81,7 +105,7 @@ func TypeCheck(v *fastjson.Value, t Type) error {
 					return
 				}
 				if t2, ok := typ.Fields[string(key)]; ok {
-					err = TypeCheck(v2, t2)
+					err = checkAt(v2, t2, string(key))
 				} else {
 					err = fmt.Errorf("field %s is not supposed to be here", string(key))
 				}
@@ -95,12 +119,15 @@ func TypeCheck(v *fastjson.Value, t Type) error {
 		a, err = v.Array()
 		if err == nil {
 			for i := range a {
-				err = TypeCheck(a[i], typ.ValueType)
+				err = checkAt(a[i], typ.ValueType, strconv.Itoa(i))
 				if err != nil {
 					break
 				}
 			}
 		}
+		if err == nil {
+			err = checkConstraints(v, t)
+		}
 		if err == nil {
 			return nil
 		}
@@ -122,7 +149,25 @@ func TypeCheck(v *fastjson.Value, t Type) error {
 	if err == nil {
 		err = fmt.Errorf("type mismatch")
 	}
-	return fmt.Errorf("value %s doesn't match %s: %s", v, t, err)
+
+	var path []string
+	if cerr, ok := err.(*CheckError); ok {
+		path = cerr.Path
+	}
+	return &CheckError{
+		Path: path,
+		Err:  fmt.Errorf("value %s doesn't match %s: %s", v, t, err),
+	}
+}
+
+func checkAt(v *fastjson.Value, t Type, key string) error {
+	err := TypeCheck(v, t)
+	if err == nil {
+		return nil
+	}
+	cerr := err.(*CheckError)
+	cerr.Path = append([]string{key}, cerr.Path...)
+	return cerr
 }
 
 func sameValue(a *fastjson.Value, b *fastjson.Value) bool {
@@ -0,0 +1,73 @@
+package potoo
+
+import (
+	"os"
+
+	"github.com/dexterlb/potoo/go/potoo/logging"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+// ValidationMode tells how values are checked against their types
+type ValidationMode int
+
+const (
+	// ValidateStrict rejects values of the wrong type
+	ValidateStrict ValidationMode = iota
+
+	// ValidateLog reports values of the wrong type as errors, but
+	// uses them anyway
+	ValidateLog
+
+	// ValidateSkip doesn't check the types of values at all
+	ValidateSkip
+)
+
+// ValidationPolicy tells how a service checks the arguments of incoming
+// calls, the results of its handlers (including streamed ones) and the
+// values it publishes
+type ValidationPolicy struct {
+	Arguments ValidationMode
+	Results   ValidationMode
+	Values    ValidationMode
+}
+
+// StrictValidationEnv is an environment variable which, if it isn't empty,
+// makes every connection use ValidateStrict for everything, whatever its
+// ValidationPolicy is. This lets a deployment which skips validation be
+// checked (e.g. in testing) without changing its code.
+const StrictValidationEnv = "POTOO_STRICT_VALIDATION"
+
+// effectiveValidation returns the policy which a connection actually uses
+func effectiveValidation(policy ValidationPolicy) ValidationPolicy {
+	if os.Getenv(StrictValidationEnv) != "" {
+		return ValidationPolicy{Arguments: ValidateStrict, Results: ValidateStrict, Values: ValidateStrict}
+	}
+	return policy
+}
+
+// the number of ValidateLog reports which may wait for the loop
+const typeReportBufferSize = 16
+
+// typeCheck checks v against t according to mode. It returns an error
+// only if the value must be rejected. It may be called from any goroutine,
+// so in ValidateLog mode the error is reported via the loop.
+func (c *Connection) typeCheck(mode ValidationMode, v *fastjson.Value, t types.Type, topic mqtt.Topic, what string) error {
+	if mode == ValidateSkip {
+		return nil
+	}
+
+	err := types.TypeCheck(v, t)
+	if err != nil && mode == ValidateLog {
+		report := newError(TypeMismatch, topic, "%s has wrong type: %w", what, err)
+		select {
+		case c.typeReports <- report:
+		default:
+			// the loop is busy (or dead), so noone will see the report
+			c.log.Warn("dropping type mismatch report", logging.KeyTopic, string(topic), logging.KeyError, report.Err)
+		}
+		return nil
+	}
+	return err
+}
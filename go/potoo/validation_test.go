@@ -0,0 +1,78 @@
+package potoo
+
+import (
+	"os"
+	"testing"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+// sloppy returns a callable which takes and returns an int, but returns
+// whatever it gets
+func sloppy(async bool) contracts.Callable {
+	return contracts.Callable{
+		Argument: types.Int(),
+		Retval:   types.Int(),
+		Async:    async,
+		Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+			return arg
+		},
+	}
+}
+
+func TestValidationModes(t *testing.T) {
+	tests := []struct {
+		mode   ValidationMode
+		reply  string
+		report bool
+	}{
+		{ValidateStrict, "error", false},
+		{ValidateLog, `"x"`, true},
+		{ValidateSkip, `"x"`, false},
+	}
+	for _, test := range tests {
+		for _, async := range []bool{false, true} {
+			b := newFakeBroker()
+			errs := make(chan *Error, 16)
+			startService(t, b, ConnectionOptions{
+				Errors:     errs,
+				Validation: ValidationPolicy{Arguments: test.mode, Results: test.mode},
+			}, contracts.Map{"echo": sloppy(async)})
+			peer, replies := b.peer("_reply/#")
+
+			peer.Publish(mqtt.Message{Topic: mqtt.Topic("_call/things/svc/echo"), Payload: []byte(`r t "x"`)})
+			_, data := parseReplyMessage(receive(t, replies, "_reply/r").Payload)
+			if test.reply == "error" {
+				if _, err := parseReply(data, nil); err == nil {
+					t.Errorf("mode %d (async: %v) accepted a value of the wrong type", test.mode, async)
+				}
+			} else if string(data) != test.reply {
+				t.Errorf("mode %d (async: %v) replied '%s' instead of %s", test.mode, async, data, test.reply)
+			}
+
+			if test.report {
+				// both the argument and the returned value
+				expectError(t, errs, TypeMismatch, "_call/things/svc/echo")
+				expectError(t, errs, TypeMismatch, "_call/things/svc/echo")
+			} else if test.mode == ValidateSkip {
+				expectNoError(t, errs)
+			}
+		}
+	}
+}
+
+func TestStrictValidationEnv(t *testing.T) {
+	os.Setenv(StrictValidationEnv, "1")
+	defer os.Unsetenv(StrictValidationEnv)
+
+	b := newFakeBroker()
+	skip := ValidationPolicy{Arguments: ValidateSkip, Results: ValidateSkip, Values: ValidateSkip}
+	startService(t, b, ConnectionOptions{Validation: skip}, contracts.Map{"echo": sloppy(false)})
+	peer, replies := b.peer("_reply/#")
+
+	peer.Publish(mqtt.Message{Topic: mqtt.Topic("_call/things/svc/echo"), Payload: []byte(`r t "x"`)})
+	expectReplyCode(t, replies, "type_mismatch")
+}
@@ -0,0 +1,224 @@
+package potoo
+
+import (
+	"sync"
+
+	"github.com/dexterlb/potoo/go/potoo/bus"
+	"github.com/dexterlb/potoo/go/potoo/codec"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+// Value returns a bus which mirrors the remote value at topic (which is
+// relative to the connection root, e.g. "<service root>/<path>"). The
+// connection subscribes to the value while the bus has subscribers.
+// Incoming values are checked against the type in the remote contract,
+// so the contract must be obtained via GetContracts.
+//
+// Handlers on the bus are called from a separate goroutine, so it is safe
+// to send values to the service's own buses from them.
+func (c *Connection) Value(topic mqtt.Topic) bus.Bus {
+	valueTopic := c.clientTopic(mqtt.Topic("_value"), topic)
+
+	c.remoteMutex.Lock()
+	defer c.remoteMutex.Unlock()
+
+	if b, ok := c.valueMirrors[string(valueTopic)]; ok {
+		return b
+	}
+
+	var a fastjson.Arena
+	b := bus.NewWithOpts(a.NewNull(), c.mirrorOpts(valueTopic))
+	c.valueMirrors[string(valueTopic)] = b
+	return b
+}
+
+// ValuePersistent is like Value, but the bus carries events of the form
+// {"event": "update", "value": <value>} as well as {"event": "online"} and
+// {"event": "offline"} when the value appears in or disappears from the
+// remote contract (or changes its type). If the topic holds a constant,
+// the event is {"event": "constant", "value": <value>}. Republishing a
+// contract only produces events for the values which have changed.
+func (c *Connection) ValuePersistent(topic mqtt.Topic) bus.Bus {
+	valueTopic := c.clientTopic(mqtt.Topic("_value"), topic)
+
+	c.remoteMutex.Lock()
+	defer c.remoteMutex.Unlock()
+
+	if b, ok := c.persistentMirrors[string(valueTopic)]; ok {
+		return b
+	}
+
+	var a fastjson.Arena
+	dflt := persistentEvent(&a, "offline", nil)
+	if rv, ok := c.remoteValues[string(valueTopic)]; ok {
+		if rv.constant != nil {
+			dflt = persistentEvent(&a, "constant", rv.constant)
+		} else {
+			dflt = persistentEvent(&a, "online", nil)
+		}
+	}
+	b := bus.NewWithOpts(dflt, c.mirrorOpts(valueTopic))
+	c.persistentMirrors[string(valueTopic)] = b
+	return b
+}
+
+func (c *Connection) mirrorOpts(valueTopic mqtt.Topic) *bus.Options {
+	return &bus.Options{
+		Logger: c.log,
+		OnFirstSubscribed: func() {
+			c.clientSubscribe(valueTopic)
+		},
+		OnLastUnsubscribed: func() {
+			c.clientUnsubscribe(valueTopic)
+		},
+	}
+}
+
+type remoteValue struct {
+	service  string
+	typ      types.Type
+	encoding codec.Codec
+	constant *fastjson.Value
+}
+
+// sameRemoteValue tells if a value or constant is unchanged in a new
+// version of a remote contract
+func sameRemoteValue(a remoteValue, b remoteValue) bool {
+	if a.constant != nil || b.constant != nil {
+		return a.constant != nil && b.constant != nil && a.constant.String() == b.constant.String()
+	}
+	return types.Equivalent(a.typ, b.typ) &&
+		codec.Or(a.encoding).Name() == codec.Or(b.encoding).Name()
+}
+
+func (c *Connection) handleRemoteValue(msg mqtt.Message) {
+	if len(msg.Payload) == 0 {
+		// the value has been cleared
+		return
+	}
+
+	c.remoteMutex.Lock()
+	defer c.remoteMutex.Unlock()
+
+	rv, ok := c.remoteValues[string(msg.Topic)]
+	if !ok {
+		// the contract may arrive later
+		c.unverifiedValues[string(msg.Topic)] = append([]byte(nil), msg.Payload...)
+		return
+	}
+	if rv.constant != nil {
+		c.err(newError(UnknownTopic, msg.Topic, "received a value for a constant"))
+		return
+	}
+
+	c.mirrorValue(string(msg.Topic), rv.typ, rv.encoding, msg.Payload)
+}
+
+// mirrorValue must be called with remoteMutex held
+func (c *Connection) mirrorValue(valueTopic string, typ types.Type, enc codec.Codec, data []byte) {
+	mirror := c.valueMirrors[valueTopic]
+	persistent := c.persistentMirrors[valueTopic]
+	if mirror == nil && persistent == nil {
+		return
+	}
+
+	// the value is delivered later, so it needs its own parser
+	v, err := codec.Or(enc).Unmarshal(nil, nil, data)
+	if err != nil {
+		c.err(newError(BadMessage, mqtt.Topic(valueTopic), "unable to parse value: %s", err))
+		return
+	}
+	err = types.TypeCheck(v, typ)
+	if err != nil {
+		c.err(newError(TypeMismatch, mqtt.Topic(valueTopic), "value has wrong type: %s", err))
+		return
+	}
+
+	c.deliveries.push(func() {
+		if mirror != nil {
+			mirror.Send(v)
+		}
+		if persistent != nil {
+			var a fastjson.Arena
+			persistent.Send(persistentEvent(&a, "update", v))
+		}
+	})
+}
+
+// notifyPersistent must be called with remoteMutex held
+func (c *Connection) notifyPersistent(valueTopic string, event string, v *fastjson.Value) {
+	persistent, ok := c.persistentMirrors[valueTopic]
+	if !ok {
+		return
+	}
+
+	c.deliveries.push(func() {
+		var a fastjson.Arena
+		persistent.Send(persistentEvent(&a, event, v))
+	})
+}
+
+func persistentEvent(a *fastjson.Arena, event string, v *fastjson.Value) *fastjson.Value {
+	o := a.NewObject()
+	o.Set("event", a.NewString(event))
+	if v != nil {
+		o.Set("value", v)
+	}
+	return o
+}
+
+// deliveryQueue runs functions in order on a separate goroutine, so that
+// bus handlers can't block the connection loop
+type deliveryQueue struct {
+	sync.Mutex
+	cond   *sync.Cond
+	items  []func()
+	closed bool
+}
+
+func newDeliveryQueue() *deliveryQueue {
+	q := &deliveryQueue{}
+	q.cond = sync.NewCond(q)
+	go q.run()
+	return q
+}
+
+func (q *deliveryQueue) push(f func()) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.items = append(q.items, f)
+	q.cond.Signal()
+}
+
+func (q *deliveryQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.closed = true
+	q.cond.Signal()
+}
+
+func (q *deliveryQueue) run() {
+	for {
+		q.Lock()
+		for len(q.items) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.items) == 0 {
+			q.Unlock()
+			return
+		}
+		f := q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+		q.Unlock()
+
+		f()
+	}
+}
@@ -0,0 +1,188 @@
+package potoo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/bus"
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+// collect subscribes to the bus and returns the values it receives
+func collect(b bus.Bus) <-chan string {
+	values := make(chan string, 64)
+	b.Subscribe(func(v *fastjson.Value) {
+		values <- v.String()
+	})
+	return values
+}
+
+func expectValue(t *testing.T, values <-chan string, want string) {
+	t.Helper()
+
+	select {
+	case v := <-values:
+		if v != want {
+			t.Errorf("got %s instead of %s", v, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("timed out waiting for %s", want)
+	}
+}
+
+func TestValueMirror(t *testing.T) {
+	b := newFakeBroker()
+	temp := bus.NewIntBus(1)
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"temp": contracts.Value{Type: types.Int(), Bus: temp},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	values := collect(cl.Value(mqtt.Topic("svc/temp")))
+	expectValue(t, values, "1")
+	temp.SendV(2)
+	expectValue(t, values, "2")
+}
+
+func TestValueMirrorTypeCheck(t *testing.T) {
+	b := newFakeBroker()
+	svc, _ := b.peer()
+	svc.publishContract(contracts.Map{
+		"temp": contracts.Value{Type: types.Int()},
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	values := collect(cl.Value(mqtt.Topic("svc/temp")))
+	eventually(t, "the client subscribes to the value", func() bool {
+		return b.subscribed("_value/things/svc/temp")
+	})
+	svc.Publish(mqtt.Message{Topic: mqtt.Topic("_value/things/svc/temp"), Payload: []byte(`"hot"`)})
+	svc.Publish(mqtt.Message{Topic: mqtt.Topic("_value/things/svc/temp"), Payload: []byte(`3`)})
+	expectValue(t, values, "3")
+}
+
+func TestValuePersistent(t *testing.T) {
+	b := newFakeBroker()
+	svc, _ := b.peer()
+	svc.publishContract(contracts.Map{
+		"temp":  contracts.Value{Type: types.Int()},
+		"label": q.StringConst("kitchen"),
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+
+	var a fastjson.Arena
+	label := cl.ValuePersistent(mqtt.Topic("svc/label")).Get(&a).String()
+	if label != `{"event":"constant","value":"kitchen"}` {
+		t.Errorf("persistent constant is %s", label)
+	}
+
+	temp := cl.ValuePersistent(mqtt.Topic("svc/temp"))
+	if online := temp.Get(&a).String(); online != `{"event":"online"}` {
+		t.Errorf("persistent value of a known service is %s", online)
+	}
+	events := collect(temp)
+	eventually(t, "the client subscribes to the value", func() bool {
+		return b.subscribed("_value/things/svc/temp")
+	})
+	svc.Publish(mqtt.Message{Topic: mqtt.Topic("_value/things/svc/temp"), Payload: []byte(`5`)})
+	expectValue(t, events, `{"event":"update","value":5}`)
+
+	svc.Publish(mqtt.Message{Topic: mqtt.Topic("_contract/things/svc"), Payload: []byte("null"), Retain: true})
+	expectValue(t, events, `{"event":"offline"}`)
+}
+
+func TestValueTypeChange(t *testing.T) {
+	b := newFakeBroker()
+	temp := bus.NewIntBus(1)
+	svc := startService(t, b, ConnectionOptions{}, contracts.Map{
+		"temp": contracts.Value{Type: types.Int(), Bus: temp},
+	})
+	eventually(t, "the service publishes the value", func() bool {
+		value, _ := b.retainedValue("_value/things/svc/temp")
+		return string(value) == "1"
+	})
+
+	b.publish(mqtt.Message{Topic: mqtt.Topic("_value/things/svc/temp"), Retain: true})
+	svc.UpdateContract(contracts.Map{
+		"temp": contracts.Value{Type: types.Float(), Bus: temp},
+	})
+	eventually(t, "the service publishes the value again", func() bool {
+		value, _ := b.retainedValue("_value/things/svc/temp")
+		return string(value) == "1"
+	})
+}
+
+func TestContractUpdateRemovals(t *testing.T) {
+	b := newFakeBroker()
+	temp := bus.NewIntBus(1)
+	humidity := bus.NewIntBus(40)
+	svc := startService(t, b, ConnectionOptions{}, contracts.Map{
+		"ping":     fast,
+		"echo":     echo(nil),
+		"temp":     contracts.Value{Type: types.Int(), Bus: temp},
+		"humidity": contracts.Value{Type: types.Int(), Bus: humidity},
+	})
+	eventually(t, "the service serves its contract", func() bool {
+		_, ok := b.retainedValue("_value/things/svc/humidity")
+		return ok && b.subscribed("_call/things/svc/ping") && b.subscribed("_batch/things/svc")
+	})
+
+	svc.UpdateContract(contracts.Map{
+		"echo": echo(nil),
+		"temp": contracts.Value{Type: types.Int(), Bus: temp},
+	})
+	eventually(t, "the removed callable and value are dropped", func() bool {
+		_, ok := b.retainedValue("_value/things/svc/humidity")
+		return !ok && !b.subscribed("_call/things/svc/ping")
+	})
+	if !b.subscribed("_call/things/svc/echo") || !b.subscribed("_batch/things/svc") {
+		t.Errorf("the service stopped serving the remaining callable")
+	}
+	if value, _ := b.retainedValue("_value/things/svc/temp"); string(value) != "1" {
+		t.Errorf("the remaining value is %s", value)
+	}
+
+	svc.UpdateContract(contracts.Map{})
+	eventually(t, "the last callable and value are dropped", func() bool {
+		_, ok := b.retainedValue("_value/things/svc/temp")
+		return !ok && !b.subscribed("_call/things/svc/echo") && !b.subscribed("_batch/things/svc")
+	})
+}
+
+func TestValuePersistentContractUpdate(t *testing.T) {
+	b := newFakeBroker()
+	svc, _ := b.peer()
+	contract := contracts.Map{
+		"temp":  contracts.Value{Type: types.Int()},
+		"label": q.StringConst("kitchen"),
+		"gone":  contracts.Value{Type: types.Int()},
+	}
+	svc.publishContract(contract)
+	cl := startClient(t, b, ConnectionOptions{})
+
+	temp := collect(cl.ValuePersistent(mqtt.Topic("svc/temp")))
+	label := collect(cl.ValuePersistent(mqtt.Topic("svc/label")))
+	gone := collect(cl.ValuePersistent(mqtt.Topic("svc/gone")))
+	eventually(t, "the client subscribes to the value", func() bool {
+		return b.subscribed("_value/things/svc/temp")
+	})
+
+	// republishing the same contract doesn't make the values flap, so the
+	// next events are the ones which follow
+	svc.publishContract(contract)
+	svc.Publish(mqtt.Message{Topic: mqtt.Topic("_value/things/svc/temp"), Payload: []byte(`5`)})
+	expectValue(t, temp, `{"event":"update","value":5}`)
+
+	svc.publishContract(contracts.Map{
+		"temp":  contracts.Value{Type: types.String()},
+		"label": q.StringConst("hall"),
+	})
+	expectValue(t, label, `{"event":"constant","value":"hall"}`)
+	expectValue(t, temp, `{"event":"offline"}`)
+	expectValue(t, temp, `{"event":"online"}`)
+	expectValue(t, gone, `{"event":"offline"}`)
+}
@@ -0,0 +1,160 @@
+package potoo
+
+import (
+	"time"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/logging"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+)
+
+const (
+	defaultMaxConcurrentCalls = 16
+	defaultCallQueueSize      = 64
+)
+
+type queuedCall struct {
+	msg      mqtt.Message        // must not share buffers with the MQTT client
+	callable *contracts.Callable // replaced if the contract changes while queued
+	caller   Caller
+	started  time.Time
+
+	batch *pendingBatch // the batch the call is part of, if any
+	index int
+}
+
+// handleAsyncCall runs the call right away if the concurrency limits
+// allow it, queues it otherwise, and rejects it if the queue is full
+func (c *Connection) handleAsyncCall(qc queuedCall) {
+	qc.started = time.Now()
+
+	if c.canStartCall(qc.msg.Topic, qc.callable) {
+		c.startAsyncCall(qc)
+		return
+	}
+
+	if len(c.callQueue) >= c.callQueueSize() {
+		err := newError(Overloaded, qc.msg.Topic, "too many pending calls")
+		if qc.batch != nil {
+			c.rejectBatchItem(qc.batch, qc.index, qc.msg, err)
+		} else {
+			c.rejectCall(qc.msg, err)
+		}
+		return
+	}
+
+	c.callQueue = append(c.callQueue, qc)
+}
+
+func (c *Connection) canStartCall(topic mqtt.Topic, callable *contracts.Callable) bool {
+	max := c.opts.MaxConcurrentCalls
+	if max == 0 {
+		max = defaultMaxConcurrentCalls
+	}
+	if max > 0 && c.runningCalls >= max {
+		return false
+	}
+
+	limit := callable.MaxConcurrent
+	if callable.Serialized {
+		limit = 1
+	}
+	return limit <= 0 || c.runningPerCallable[string(topic)] < limit
+}
+
+func (c *Connection) callQueueSize() int {
+	switch {
+	case c.opts.CallQueueSize == 0:
+		return defaultCallQueueSize
+	case c.opts.CallQueueSize < 0:
+		return 0
+	default:
+		return c.opts.CallQueueSize
+	}
+}
+
+func (c *Connection) startAsyncCall(qc queuedCall) {
+	c.runningCalls++
+	c.runningPerCallable[string(qc.msg.Topic)]++
+
+	go func() {
+		arena := c.arenaPool.Get()
+		parser := c.parserPool.Get()
+		result := c.handleCallHelper(arena, parser, qc.msg, qc.callable, qc.caller)
+
+		c.deathMutex.Lock()
+		defer c.deathMutex.Unlock()
+		if c.dead {
+			// the potoo service died while handling the call, there
+			// is noone to return the result to
+			return
+		}
+
+		c.asyncCalls <- asyncCallResult{
+			callResult: result,
+			callTopic:  qc.msg.Topic,
+			started:    qc.started,
+			batch:      qc.batch,
+			index:      qc.index,
+			arena:      arena,
+			parser:     parser,
+		}
+	}()
+}
+
+// asyncCallDone releases the slot of a finished call and starts the
+// queued calls which can run now
+func (c *Connection) asyncCallDone(topic mqtt.Topic) {
+	c.runningCalls--
+	c.runningPerCallable[string(topic)]--
+	if c.runningPerCallable[string(topic)] <= 0 {
+		delete(c.runningPerCallable, string(topic))
+	}
+
+	c.startQueuedCalls()
+}
+
+// startQueuedCalls starts as many queued calls as the limits allow, in the
+// order they arrived. Calls are handled by the current version of their
+// callable, and rejected if it has been removed from the contract.
+func (c *Connection) startQueuedCalls() {
+	queue := c.callQueue[:0]
+	for _, qc := range c.callQueue {
+		callable, ok := c.serviceCallableIndex[string(qc.msg.Topic)]
+		if !ok {
+			err := newError(UnknownTopic, qc.msg.Topic, "the callable has been removed")
+			if qc.batch != nil {
+				c.rejectBatchItem(qc.batch, qc.index, qc.msg, err)
+			} else {
+				c.rejectCall(qc.msg, err)
+			}
+			continue
+		}
+		qc.callable = callable
+
+		if c.canStartCall(qc.msg.Topic, qc.callable) {
+			c.startAsyncCall(qc)
+		} else {
+			queue = append(queue, qc)
+		}
+	}
+	for i := len(queue); i < len(c.callQueue); i++ {
+		c.callQueue[i] = queuedCall{} // don't keep the messages alive
+	}
+	c.callQueue = queue
+}
+
+func (c *Connection) rejectCall(msg mqtt.Message, err *Error) {
+	h := parseCallMessage(msg.Payload)
+
+	result := callResult{err: err}
+	if len(h.replyTopic) != 0 {
+		result.topic = mqtt.JoinTopics(mqtt.Topic("_reply"), mqtt.Topic(h.replyTopic))
+		result.token = h.token
+		result.version = h.version
+	}
+	c.log.Warn("call rejected", logging.KeyTopic, string(msg.Topic), logging.KeyToken, string(h.token),
+		logging.KeyError, err.Err)
+	c.recordRejectedCall(msg.Topic)
+	c.finaliseCall(result)
+}
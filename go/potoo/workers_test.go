@@ -0,0 +1,202 @@
+package potoo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dexterlb/potoo/go/potoo/contracts"
+	"github.com/dexterlb/potoo/go/potoo/mqtt"
+	"github.com/dexterlb/potoo/go/potoo/q"
+	"github.com/dexterlb/potoo/go/potoo/types"
+	"github.com/valyala/fastjson"
+)
+
+// serialized returns a serialized callable which returns n once release
+// is closed, and tells when it starts on started
+func serialized(n int, started chan<- struct{}, release <-chan struct{}) contracts.Callable {
+	return contracts.Callable{
+		Argument:   types.Null(),
+		Retval:     types.Int(),
+		Async:      true,
+		Serialized: true,
+		Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+			started <- struct{}{}
+			<-release
+			return a.NewNumberInt(n)
+		},
+	}
+}
+
+var fast = contracts.Callable{
+	Argument: types.Null(),
+	Retval:   types.Null(),
+	Handler: func(a *fastjson.Arena, arg *fastjson.Value) *fastjson.Value {
+		return a.NewNull()
+	},
+}
+
+// queueSecondCall makes two calls to svc/slow and returns once the
+// service has queued the second one
+func queueSecondCall(t *testing.T, cl *Connection, calls <-chan mqtt.Message, started <-chan struct{}) (<-chan callOutcome, <-chan callOutcome) {
+	t.Helper()
+
+	first := callAsync(cl, "svc/slow")
+	<-started
+	receive(t, calls, "_call/things/svc/slow")
+	second := callAsync(cl, "svc/slow")
+	receive(t, calls, "_call/things/svc/slow")
+
+	// the service handles calls in order, so by the time this returns
+	// the second call has been queued
+	_, err := cl.Call(context.Background(), mqtt.Topic("svc/fast"), q.Json(nil))
+	if err != nil {
+		t.Fatalf("call failed: %s", err)
+	}
+	return first, second
+}
+
+type callOutcome struct {
+	value *fastjson.Value
+	err   error
+}
+
+func callAsync(cl *Connection, topic string) <-chan callOutcome {
+	outcome := make(chan callOutcome, 1)
+	go func() {
+		v, err := cl.Call(context.Background(), mqtt.Topic(topic), q.Json(nil))
+		outcome <- callOutcome{value: v, err: err}
+	}()
+	return outcome
+}
+
+func TestSerializedCalls(t *testing.T) {
+	b := newFakeBroker()
+	started := make(chan struct{}, 16)
+	release := make(chan struct{})
+	startService(t, b, ConnectionOptions{}, contracts.Map{
+		"slow": serialized(1, started, release),
+		"fast": fast,
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+	_, calls := b.peer("_call/#")
+
+	first, second := queueSecondCall(t, cl, calls, started)
+	select {
+	case <-started:
+		t.Fatalf("a serialized callable was started twice")
+	default:
+	}
+
+	close(release)
+	for _, outcome := range []<-chan callOutcome{first, second} {
+		o := <-outcome
+		if o.err != nil || o.value.GetInt() != 1 {
+			t.Errorf("call returned (%v, %v)", o.value, o.err)
+		}
+	}
+}
+
+func TestQueuedCallContractUpdate(t *testing.T) {
+	b := newFakeBroker()
+	started := make(chan struct{}, 16)
+	release := make(chan struct{})
+	svc := startService(t, b, ConnectionOptions{}, contracts.Map{
+		"slow": serialized(1, started, release),
+		"fast": fast,
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+	_, calls := b.peer("_call/#")
+
+	first, second := queueSecondCall(t, cl, calls, started)
+
+	svc.UpdateContract(contracts.Map{
+		"slow": serialized(2, started, release),
+		"fast": fast,
+	})
+	close(release)
+	if o := <-first; o.err != nil || o.value.GetInt() != 1 {
+		t.Errorf("the running call returned (%v, %v)", o.value, o.err)
+	}
+	if o := <-second; o.err != nil || o.value.GetInt() != 2 {
+		t.Errorf("the queued call returned (%v, %v) instead of using the new callable", o.value, o.err)
+	}
+}
+
+func TestQueuedCallRemoved(t *testing.T) {
+	b := newFakeBroker()
+	started := make(chan struct{}, 16)
+	release := make(chan struct{})
+	svc := startService(t, b, ConnectionOptions{}, contracts.Map{
+		"slow": serialized(1, started, release),
+		"fast": fast,
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+	_, calls := b.peer("_call/#")
+
+	first, second := queueSecondCall(t, cl, calls, started)
+
+	svc.UpdateContract(contracts.Map{"fast": fast})
+	o := <-second
+	var rerr *RemoteError
+	if !errors.As(o.err, &rerr) || rerr.Code != "unknown_topic" {
+		t.Errorf("the queued call of a removed callable returned (%v, %v)", o.value, o.err)
+	}
+	close(release)
+	<-first
+}
+
+func TestOverloaded(t *testing.T) {
+	b := newFakeBroker()
+	started := make(chan struct{}, 16)
+	release := make(chan struct{})
+	unserialized := func(n int) contracts.Callable {
+		callable := serialized(n, started, release)
+		callable.Serialized = false
+		return callable
+	}
+	svc := startService(t, b, ConnectionOptions{MaxConcurrentCalls: 1, CallQueueSize: 1}, contracts.Map{
+		"slow":  unserialized(1),
+		"other": unserialized(1),
+		"fast":  fast,
+	})
+	cl := startClient(t, b, ConnectionOptions{})
+	_, calls := b.peer("_call/#")
+
+	first := callAsync(cl, "svc/slow")
+	<-started
+	receive(t, calls, "_call/things/svc/slow")
+
+	// the limit is shared by all callables
+	second := callAsync(cl, "svc/other")
+	receive(t, calls, "_call/things/svc/other")
+	third := callAsync(cl, "svc/slow")
+	o := <-third
+	var rerr *RemoteError
+	if !errors.As(o.err, &rerr) || rerr.Code != "overloaded" {
+		t.Errorf("the call over the queue size returned (%v, %v)", o.value, o.err)
+	}
+	select {
+	case <-started:
+		t.Fatalf("a call was started over the limit")
+	default:
+	}
+
+	// synchronous calls aren't limited
+	if _, err := cl.Call(context.Background(), mqtt.Topic("svc/fast"), q.Json(nil)); err != nil {
+		t.Errorf("synchronous call failed: %s", err)
+	}
+
+	svc.UpdateContract(contracts.Map{
+		"slow":  unserialized(1),
+		"other": unserialized(2),
+		"fast":  fast,
+	})
+	close(release)
+	if o := <-first; o.err != nil || o.value.GetInt() != 1 {
+		t.Errorf("the running call returned (%v, %v)", o.value, o.err)
+	}
+	if o := <-second; o.err != nil || o.value.GetInt() != 2 {
+		t.Errorf("the queued call returned (%v, %v) instead of using the new callable", o.value, o.err)
+	}
+}